@@ -0,0 +1,13 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// pinThread binds the calling os thread to one cpu, the goroutine has to be locked to its thread already
+func pinThread(cpu int) error {
+	var set unix.CPUSet
+	set.Zero()
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
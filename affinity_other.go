@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "github.com/pkg/errors"
+
+func pinThread(cpu int) error {
+	return errors.New("cpu affinity is only supported on linux")
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kApiVersion = "1.0.0"
+	kApiKind    = "cpu"
+)
+
+// Api serves the xmrig style http api, /1/summary /1/threads /1/config, prometheus /metrics, and POST /json_rpc to control the miner
+type Api struct {
+	miner   *Miner
+	token   string
+	server  *http.Server
+	mux     *http.ServeMux
+	metrics *Metrics
+}
+
+type ApiHashrate struct {
+	Total   []*float64   `json:"total"`
+	Highest float64      `json:"highest"`
+	Threads [][]*float64 `json:"threads"`
+}
+
+type ApiResults struct {
+	DiffCurrent   float64 `json:"diff_current"`
+	SharesGood    uint64  `json:"shares_good"`
+	SharesTotal   uint64  `json:"shares_total"`
+	SharesStale   uint64  `json:"shares_stale"`
+	SharesInvalid uint64  `json:"shares_invalid"`
+	HashesTotal   uint64  `json:"hashes_total"`
+
+	PoolErrors map[string]uint64 `json:"pool_errors"`
+}
+
+type ApiConnection struct {
+	Pool     string  `json:"pool"`
+	State    string  `json:"state"`
+	Algo     string  `json:"algo"`
+	Height   uint64  `json:"height"`
+	Diff     float64 `json:"diff"`
+	Accepted uint64  `json:"accepted"`
+	Rejected uint64  `json:"rejected"`
+}
+
+type ApiSummary struct {
+	Id         string        `json:"id"`
+	WorkerId   string        `json:"worker_id"`
+	Uptime     int64         `json:"uptime"`
+	Version    string        `json:"version"`
+	Kind       string        `json:"kind"`
+	Algo       string        `json:"algo"`
+	Paused     bool          `json:"paused"`
+	Threads    int           `json:"threads"`
+	Hashrate   ApiHashrate   `json:"hashrate"`
+	Results    ApiResults    `json:"results"`
+	Connection ApiConnection `json:"connection"`
+}
+
+type ApiThread struct {
+	Type     string     `json:"type"`
+	Algo     string     `json:"algo"`
+	Hashes   uint64     `json:"hashes"`
+	Hashrate []*float64 `json:"hashrate"`
+	Affinity int        `json:"affinity"`
+}
+
+type ApiThreads struct {
+	Threads []ApiThread `json:"threads"`
+}
+
+type ApiPool struct {
+	Url         string `json:"url"`
+	User        string `json:"user"`
+	Algo        string `json:"algo"`
+	Tls         bool   `json:"tls"`
+	Fingerprint string `json:"tls-fingerprint"`
+	Protocol    string `json:"protocol"`
+	Daemon      bool   `json:"daemon"`
+}
+
+type ApiConfig struct {
+	Pools   []ApiPool `json:"pools"`
+	Threads int       `json:"threads"`
+}
+
+type ApiRpcReq struct {
+	Id     interface{}     `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type ApiRpcRsp struct {
+	Id      interface{} `json:"id"`
+	JsonRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   *ErrorReply `json:"error,omitempty"`
+}
+
+type ApiRpcParams struct {
+	Threads int    `json:"threads"`
+	Index   *int   `json:"index"`
+	Url     string `json:"url"`
+}
+
+func NewApi(addr string, token string, m *Miner) (*Api, error) {
+	a := &Api{
+		miner:   m,
+		token:   token,
+		mux:     http.NewServeMux(),
+		metrics: NewMetrics(m),
+	}
+
+	a.handle("/1/summary", a.summary)
+	a.handle("/1/threads", a.threads)
+	a.handle("/1/config", a.config)
+	a.mux.HandleFunc("/metrics", a.authed(a.metrics.serve))
+	a.mux.HandleFunc("/json_rpc", a.control)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	a.server = &http.Server{Handler: a.mux}
+	go func() {
+		defer common.CrashLog()
+		err := a.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			loggo.Error("Api serve fail %v", err)
+		}
+	}()
+
+	loggo.Info("Api listen ok %v", listener.Addr())
+
+	return a, nil
+}
+
+func (a *Api) Close() {
+	a.server.Close()
+}
+
+// handle registers a json handler
+func (a *Api) handle(path string, f func() interface{}) {
+	a.mux.HandleFunc(path, a.authed(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		enc.Encode(f())
+	}))
+}
+
+// authed only lets GET requests through, and checks the bearer token when one is configured
+func (a *Api) authed(f http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.auth(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func (a *Api) auth(r *http.Request) bool {
+	if a.token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	// constant time, the token guards the control methods
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) == 1
+}
+
+func (a *Api) summary() interface{} {
+	m := a.miner
+
+	s := &ApiSummary{
+		Version: kApiVersion,
+		Kind:    kApiKind,
+		Uptime:  int64(time.Now().Sub(m.start) / time.Second),
+	}
+	s.WorkerId, _ = os.Hostname()
+	s.Id = s.WorkerId
+	s.Paused = m.isPaused()
+	s.Threads = m.threads()
+
+	m.lock.Lock()
+	s.Hashrate.Total = m.hashrate.windows(-1)
+	s.Hashrate.Highest = m.hashrate.highest
+	for i := range m.workers {
+		s.Hashrate.Threads = append(s.Hashrate.Threads, m.hashrate.windows(i))
+	}
+	m.lock.Unlock()
+
+	pool := m.pool.current()
+	s.Connection.Pool = pool.url
+	s.Connection.State = m.pool.stateName()
+	snap := m.stat.snapshot()
+	s.Connection.Accepted = snap.accepted
+	s.Connection.Rejected = snap.rejected()
+
+	if j := m.currentJob(); j != nil {
+		s.Algo = j.algorithm.name()
+		s.Connection.Algo = s.Algo
+		s.Connection.Height = j.height
+		s.Connection.Diff = j.diff
+		s.Results.DiffCurrent = j.diff
+	} else if pool.algo != nil {
+		s.Algo = pool.algo.name()
+		s.Connection.Algo = s.Algo
+	}
+
+	s.Results.SharesGood = snap.accepted
+	s.Results.SharesTotal = snap.submitted
+	s.Results.SharesStale = snap.stale
+	s.Results.SharesInvalid = snap.invalid
+	s.Results.HashesTotal = snap.hashes
+	s.Results.PoolErrors = make(map[string]uint64)
+	for kind, name := range kPoolErrorNames {
+		s.Results.PoolErrors[name] = snap.poolErrors[kind]
+	}
+
+	return s
+}
+
+// control takes xmrig style json rpc: pause, resume, threads {"threads":n}, switch_pool {"index":n} or {"url":u}
+func (a *Api) control(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" {
+		http.Error(w, "Forbidden, set -apitoken to enable control", http.StatusForbidden)
+		return
+	}
+	if !a.auth(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ApiRpcReq
+	rsp := &ApiRpcRsp{JsonRPC: "2.0"}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		rsp.Error = &ErrorReply{Code: -32700, Message: "Parse error"}
+	} else {
+		rsp.Id = req.Id
+		err = a.call(&req)
+		if err != nil {
+			rsp.Error = &ErrorReply{Code: -32602, Message: err.Error()}
+		} else {
+			rsp.Result = &StatusReply{Status: "OK"}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func (a *Api) call(req *ApiRpcReq) error {
+	m := a.miner
+
+	var params ApiRpcParams
+	if len(req.Params) > 0 {
+		err := json.Unmarshal(req.Params, &params)
+		if err != nil {
+			return err
+		}
+	}
+
+	loggo.Warn("Api control %v %v", req.Method, string(req.Params))
+
+	switch req.Method {
+	case "pause":
+		m.pause()
+		return nil
+	case "resume":
+		m.resume()
+		return nil
+	case "threads":
+		if params.Threads <= 0 {
+			return errors.New("threads must be positive")
+		}
+		m.setThreads(params.Threads)
+		return nil
+	case "switch_pool":
+		if params.Index != nil {
+			return m.usePool(*params.Index)
+		}
+		for i, pool := range m.pool.poolList() {
+			if pool.url == params.Url {
+				return m.usePool(i)
+			}
+		}
+		return errors.New("no pool " + params.Url)
+	}
+
+	return errors.New("unknown method " + req.Method)
+}
+
+func (a *Api) threads() interface{} {
+	m := a.miner
+
+	algo := ""
+	if j := m.currentJob(); j != nil {
+		algo = j.algorithm.name()
+	}
+
+	t := &ApiThreads{}
+	m.lock.Lock()
+	for i, w := range m.workers {
+		t.Threads = append(t.Threads, ApiThread{
+			Type:     kApiKind,
+			Algo:     algo,
+			Hashes:   atomic.LoadUint64(&w.hashes),
+			Hashrate: m.hashrate.windows(i),
+			Affinity: w.cpu,
+		})
+	}
+	m.lock.Unlock()
+
+	return t
+}
+
+func (a *Api) config() interface{} {
+	m := a.miner
+
+	c := &ApiConfig{
+		Threads: m.threads(),
+	}
+	for _, pool := range m.pool.poolList() {
+		p := ApiPool{
+			Url:         pool.url,
+			User:        pool.user,
+			Tls:         pool.tls,
+			Fingerprint: pool.tlsfp,
+			Protocol:    pool.proto,
+			Daemon:      pool.daemon,
+		}
+		if pool.algo != nil {
+			p.Algo = pool.algo.name()
+		}
+		c.Pools = append(c.Pools, p)
+	}
+	return c
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMiner mines the stub pool with one thread
+func newTestMiner(t *testing.T) (*Miner, *StubPool) {
+	p, err := NewStubPool("127.0.0.1:0", "cn/0", "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+
+	pool, err := NewPool(p.server.listener.Addr().String(), "cn/0", "rig", "x", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lifetime, err := NewLifetime("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewMiner([]*Pool{pool}, StratumConfig{}, 1, nil, lifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.shutdown)
+	return m, p
+}
+
+func newTestApi(t *testing.T, token string) (*Api, *Miner) {
+	m, _ := newTestMiner(t)
+	a, err := NewApi("127.0.0.1:0", token, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Close)
+	return a, m
+}
+
+func apiRequest(a *Api, method, path, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	a.mux.ServeHTTP(w, r)
+	return w
+}
+
+// apiCall posts a json rpc call and returns the error message, empty when it answered OK
+func apiCall(t *testing.T, a *Api, token, method, params string) string {
+	body := `{"id":1,"jsonrpc":"2.0","method":"` + method + `"`
+	if params != "" {
+		body += `,"params":` + params
+	}
+	w := apiRequest(a, http.MethodPost, "/json_rpc", token, body+"}")
+	if w.Code != http.StatusOK {
+		t.Fatalf("%v answered %v %v", method, w.Code, w.Body.String())
+	}
+	var rsp struct {
+		Result *StatusReply `json:"result"`
+		Error  *ErrorReply  `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.Error != nil {
+		return rsp.Error.Message
+	}
+	if rsp.Result == nil || rsp.Result.Status != "OK" {
+		t.Fatalf("%v answered %v", method, w.Body.String())
+	}
+	return ""
+}
+
+func TestApiAuth(t *testing.T) {
+	a, _ := newTestApi(t, "secret")
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/1/summary", "", http.StatusUnauthorized},
+		{http.MethodGet, "/1/summary", "secre", http.StatusUnauthorized},
+		{http.MethodGet, "/1/summary", "secret", http.StatusOK},
+		{http.MethodPost, "/1/summary", "secret", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/metrics", "", http.StatusUnauthorized},
+		{http.MethodGet, "/metrics", "secret", http.StatusOK},
+		{http.MethodPost, "/json_rpc", "", http.StatusUnauthorized},
+		{http.MethodPost, "/json_rpc", "secret2", http.StatusUnauthorized},
+		{http.MethodGet, "/json_rpc", "secret", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := apiRequest(a, tt.method, tt.path, tt.token, `{"method":"pause"}`)
+		if w.Code != tt.code {
+			t.Errorf("%v %v token %q answered %v, want %v", tt.method, tt.path, tt.token, w.Code, tt.code)
+		}
+	}
+	if a.miner.isPaused() {
+		t.Error("paused by a request without the token")
+	}
+
+	// without a token the api is read only
+	open := &Api{miner: a.miner, mux: http.NewServeMux()}
+	open.mux.HandleFunc("/json_rpc", open.control)
+	if w := apiRequest(open, http.MethodPost, "/json_rpc", "", `{"method":"pause"}`); w.Code != http.StatusForbidden {
+		t.Errorf("control without -apitoken answered %v", w.Code)
+	}
+}
+
+func TestApiControl(t *testing.T) {
+	a, m := newTestApi(t, "t")
+	nextMinerJob(t, m)
+
+	if err := apiCall(t, a, "t", "pause", ""); err != "" || !m.isPaused() {
+		t.Fatalf("pause answered %q, paused %v", err, m.isPaused())
+	}
+	for _, w := range m.workers {
+		if w.wj != nil {
+			t.Error("worker still has a job while paused")
+		}
+	}
+	if err := apiCall(t, a, "t", "resume", ""); err != "" || m.isPaused() {
+		t.Fatalf("resume answered %q, paused %v", err, m.isPaused())
+	}
+
+	if err := apiCall(t, a, "t", "threads", `{"threads":2}`); err != "" || m.threads() != 2 {
+		t.Errorf("threads answered %q, %v threads", err, m.threads())
+	}
+	if err := apiCall(t, a, "t", "threads", `{"threads":0}`); err == "" || m.threads() != 2 {
+		t.Errorf("threads 0 answered %q, %v threads", err, m.threads())
+	}
+
+	for _, params := range []string{`{"index":1}`, `{"index":-1}`, `{"url":"nowhere:1"}`} {
+		if err := apiCall(t, a, "t", "switch_pool", params); !strings.HasPrefix(err, "no pool") {
+			t.Errorf("switch_pool %v answered %q", params, err)
+		}
+	}
+	if err := apiCall(t, a, "t", "switch_pool", `{"index":0}`); err != "" {
+		t.Errorf("switch_pool to the current pool answered %q", err)
+	}
+	if err := apiCall(t, a, "t", "reboot", ""); err != "unknown method reboot" {
+		t.Errorf("unknown method answered %q", err)
+	}
+}
+
+// nextMinerJob waits until the miner got a job from the pool
+func nextMinerJob(t *testing.T, m *Miner) *Job {
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		if j := m.currentJob(); j != nil {
+			return j
+		}
+	}
+	t.Fatal("no job")
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/esrrhs/gohome/crypto"
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/pkg/errors"
@@ -8,8 +9,9 @@ import (
 )
 
 type Benchmark struct {
-	exit  bool
-	algos []*Algorithm
+	ctx    context.Context
+	cancel context.CancelFunc
+	algos  []*Algorithm
 }
 
 func NewBenchmark(algo string) (*Benchmark, error) {
@@ -21,6 +23,7 @@ func NewBenchmark(algo string) (*Benchmark, error) {
 	}
 
 	b := &Benchmark{}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
 
 	for _, alname := range algos {
 		al := NewAlgorithm(alname)
@@ -40,7 +43,7 @@ func NewBenchmark(algo string) (*Benchmark, error) {
 }
 
 func (b *Benchmark) Stop() {
-	b.exit = true
+	b.cancel()
 }
 
 func (b *Benchmark) Run() {
@@ -51,11 +54,11 @@ func (b *Benchmark) Run() {
 
 	cy := crypto.NewCrypto("")
 
-	for !b.exit {
+	for b.ctx.Err() == nil {
 		for _, al := range b.algos {
 			start := time.Now()
 			n := 0
-			for i := 0; i < 1024 && !b.exit; i++ {
+			for i := 0; i < 1024 && b.ctx.Err() == nil; i++ {
 				cy.Sum(input[:], al.supportAlgoName(), 0)
 				n++
 				if time.Now().Sub(start) > time.Second*5 {
@@ -65,7 +68,7 @@ func (b *Benchmark) Run() {
 			elapse := time.Now().Sub(start)
 			speed := float32(n) / float32(elapse/time.Second)
 			loggo.Info("Benchmark Algo=%v HashSpeed=%v/s", al.supportAlgoName(), speed)
-			if b.exit {
+			if b.ctx.Err() != nil {
 				break
 			}
 		}
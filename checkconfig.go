@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/esrrhs/gohome/crypto"
+	"net"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	kBase58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+	// cryptonote addresses run from 95 chars (monero standard) to 106 (integrated) and a few more for long prefixes like haven's
+	kWalletMinLen = 95
+	kWalletMaxLen = 110
+)
+
+type CheckIssue struct {
+	Level   string `json:"level"` // error or warning
+	Where   string `json:"where"`
+	Message string `json:"message"`
+}
+
+type CheckPool struct {
+	Url      string `json:"url"`
+	User     string `json:"user"`
+	Algo     string `json:"algo"`
+	Protocol string `json:"protocol"`
+	Tls      bool   `json:"tls"`
+	Daemon   bool   `json:"daemon"`
+	Ok       bool   `json:"ok"`
+}
+
+type CheckAlgo struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+	Ok      bool   `json:"ok"`
+}
+
+// CheckReport is what -type check-config prints, any error makes the process exit non zero
+type CheckReport struct {
+	Ok       bool         `json:"ok"`
+	Errors   int          `json:"errors"`
+	Warnings int          `json:"warnings"`
+	Config   string       `json:"config,omitempty"`
+	Threads  int          `json:"threads"`
+	Pools    []CheckPool  `json:"pools"`
+	Algos    []CheckAlgo  `json:"algos"`
+	Issues   []CheckIssue `json:"issues"`
+}
+
+func (r *CheckReport) error(where string, format string, a ...interface{}) {
+	r.Errors++
+	r.Issues = append(r.Issues, CheckIssue{Level: "error", Where: where, Message: fmt.Sprintf(format, a...)})
+}
+
+func (r *CheckReport) warn(where string, format string, a ...interface{}) {
+	r.Warnings++
+	r.Issues = append(r.Issues, CheckIssue{Level: "warning", Where: where, Message: fmt.Sprintf(format, a...)})
+}
+
+func (r *CheckReport) String() string {
+	data, _ := json.MarshalIndent(r, "", "    ")
+	return string(data)
+}
+
+// CheckOptions is the resolved config and flags to check, the same values the miner would start with
+type CheckOptions struct {
+	mode     string // the -type to check for, miner solo or proxy
+	config   string
+	confErr  error
+	pools    []ConfigPool
+	thread   int
+	affinity string
+	proxy    string
+	api      string
+	apitoken string
+	onerror  string
+}
+
+// checkConfig validates everything the miner can know before connecting and collects all problems instead of stopping at the first
+func checkConfig(o *CheckOptions) *CheckReport {
+	r := &CheckReport{
+		Config:  o.config,
+		Threads: o.thread,
+		Pools:   []CheckPool{},
+		Algos:   []CheckAlgo{},
+		Issues:  []CheckIssue{},
+	}
+
+	if o.confErr != nil {
+		r.error("config", "%v", o.confErr)
+	}
+
+	if o.mode != "miner" && o.mode != "solo" && o.mode != "proxy" {
+		r.error("checktype", "unknown type %v, check miner, solo or proxy", o.mode)
+	}
+
+	checkConfigPools(r, o.pools)
+
+	if o.thread <= 0 {
+		r.error("threads", "thread count %v must be positive", o.thread)
+	} else if o.thread > runtime.NumCPU() {
+		r.warn("threads", "%v threads on %v cpus", o.thread, runtime.NumCPU())
+	}
+
+	if cpus, err := parseAffinity(o.affinity); err != nil {
+		r.error("affinity", "%v", err)
+	} else if len(cpus) > 0 {
+		if runtime.GOOS != "linux" {
+			r.warn("affinity", "only supported on linux, threads are not pinned")
+		}
+		for _, cpu := range cpus {
+			if cpu >= runtime.NumCPU() {
+				r.warn("affinity", "cpu %v is not one of the %v cpus", cpu, runtime.NumCPU())
+			}
+		}
+		if len(cpus) < o.thread {
+			r.warn("affinity", "%v threads share %v cpus", o.thread, len(cpus))
+		}
+	}
+
+	if _, err := parseProxyUrl(o.proxy); err != nil {
+		r.error("proxy", "%v", err)
+	}
+
+	if _, err := parseReactions(o.onerror); err != nil {
+		r.error("onerror", "%v", err)
+	}
+
+	if o.api != "" && o.mode == "proxy" {
+		r.warn("api", "%v is not served by -type proxy, it is ignored", o.api)
+	} else if o.api != "" {
+		host, _, err := net.SplitHostPort(o.api)
+		if err != nil {
+			r.error("api", "invalid listen addr %v: %v", o.api, err)
+		} else if o.apitoken == "" && !isLoopback(host) {
+			r.warn("api", "%v has no access token and is reachable from the network", o.api)
+		}
+	}
+
+	r.Ok = r.Errors == 0
+	return r
+}
+
+func checkConfigPools(r *CheckReport, specs []ConfigPool) {
+	if len(specs) == 0 {
+		r.error("pools", "no enabled pool")
+		return
+	}
+
+	var parsed []*Pool
+	algos := make(map[string]bool)
+	for i, spec := range specs {
+		where := "pool " + strconv.Itoa(i) + " " + spec.Url
+		cp := CheckPool{
+			Url:      spec.Url,
+			User:     spec.User,
+			Algo:     spec.Algo,
+			Protocol: spec.Protocol,
+		}
+
+		// the algo is checked once per name below, so a bad one doesn't fail every pool using it
+		p, err := NewPool(spec.Url, "", spec.User, spec.Pass, spec.Tls, spec.TlsFingerprint, spec.Protocol)
+		if err != nil {
+			r.error(where, "%v", err)
+		} else {
+			cp.Tls = p.tls
+			cp.Daemon = p.daemon
+			cp.Ok = true
+		}
+
+		if spec.TlsFingerprint != "" {
+			fp := normalizeFingerprint(spec.TlsFingerprint)
+			if _, err := hex.DecodeString(fp); err != nil || len(fp) != 64 {
+				r.error(where, "tls fingerprint %v is not a sha256 hex digest", spec.TlsFingerprint)
+				cp.Ok = false
+			}
+			if p != nil && !p.tls {
+				r.warn(where, "tls fingerprint set but tls is off, it is ignored")
+			}
+		}
+
+		if spec.Algo == "" {
+			if cp.Daemon {
+				r.error(where, "daemon pool needs algo")
+				cp.Ok = false
+			} else {
+				r.warn(where, "no algo, the pool has to send it with every job")
+			}
+		} else {
+			algos[spec.Algo] = true
+		}
+
+		if msg := checkWallet(spec.User); msg != "" {
+			// pools also take account names, only the daemon really needs an address to build the block template
+			if cp.Daemon || strings.Contains(msg, "base58") {
+				r.error(where, "user %v", msg)
+				cp.Ok = false
+			} else {
+				r.warn(where, "user %v", msg)
+			}
+		}
+
+		if p != nil {
+			parsed = append(parsed, p)
+		}
+		r.Pools = append(r.Pools, cp)
+	}
+
+	if len(parsed) > 0 {
+		if err := checkPoolMix(parsed, parsed[0].daemon); err != nil {
+			r.error("pools", "%v", err)
+		}
+	}
+
+	names := make([]string, 0, len(algos))
+	for name := range algos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.Algos = append(r.Algos, checkAlgoName(r, name))
+	}
+}
+
+// checkAlgoName resolves the name and runs the backend self test on a known hash
+func checkAlgoName(r *CheckReport, name string) CheckAlgo {
+	where := "algo " + name
+	ca := CheckAlgo{Name: name}
+
+	al := NewAlgorithm(name)
+	if al.id == INVALID {
+		r.error(where, "unknown algo")
+		return ca
+	}
+	ca.Backend = al.supportAlgoName()
+	if ca.Backend == "" {
+		r.error(where, "%v has no hash backend", al.name())
+		return ca
+	}
+	if !crypto.TestSum(ca.Backend) {
+		r.error(where, "%v self test fail", ca.Backend)
+		return ca
+	}
+	ca.Ok = true
+	return ca
+}
+
+// checkWallet guesses whether the login is a cryptonote address, pools allow addr.worker and addr+diff, returns why not or ""
+func checkWallet(user string) string {
+	if user == "" {
+		return "is empty"
+	}
+	addr := user
+	if i := strings.IndexAny(addr, ".+:/"); i >= 0 {
+		addr = addr[:i]
+	}
+	for _, c := range addr {
+		if !strings.ContainsRune(kBase58Alphabet, c) {
+			if len(addr) >= kWalletMinLen {
+				return "has " + strconv.QuoteRune(c) + " which is not base58, the address has a typo"
+			}
+			return "does not look like a wallet address"
+		}
+	}
+	if len(addr) < kWalletMinLen || len(addr) > kWalletMaxLen {
+		return "does not look like a wallet address, " + strconv.Itoa(len(addr)) + " chars"
+	}
+	return ""
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckConfigApi(t *testing.T) {
+	tests := []struct {
+		mode  string
+		api   string
+		token string
+		where string // the issue expected, empty none
+		level string
+	}{
+		{"miner", "127.0.0.1:8080", "", "", ""},
+		{"miner", "0.0.0.0:8080", "", "api", "warning"},
+		{"miner", "0.0.0.0:8080", "secret", "", ""},
+		{"miner", "8080", "", "api", "error"},
+		{"solo", "127.0.0.1:8080", "", "", ""},
+		{"proxy", "", "", "", ""},
+		{"proxy", "127.0.0.1:8080", "secret", "api", "warning"},
+		{"pool", "", "", "checktype", "error"},
+	}
+	for _, tt := range tests {
+		// no pools, checking an algo hashes with it, the pool error is not looked at
+		r := checkConfig(&CheckOptions{
+			mode:     tt.mode,
+			thread:   1,
+			api:      tt.api,
+			apitoken: tt.token,
+		})
+		var got []CheckIssue
+		for _, issue := range r.Issues {
+			if issue.Where == "api" || issue.Where == "checktype" {
+				got = append(got, issue)
+			}
+		}
+		if tt.where == "" {
+			if len(got) != 0 {
+				t.Errorf("%v %v: unexpected %v", tt.mode, tt.api, got)
+			}
+			continue
+		}
+		if len(got) != 1 || got[0].Where != tt.where || got[0].Level != tt.level {
+			t.Errorf("%v %v: got %v want %v %v", tt.mode, tt.api, got, tt.level, tt.where)
+		}
+	}
+}
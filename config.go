@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/pkg/errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Config is the -config file, the fields follow xmrig's config.json so fleet configs can be reused, unknown keys are ignored
+type Config struct {
+	Pools       []ConfigPool `json:"pools"`
+	Cpu         ConfigCpu    `json:"cpu"`
+	Http        ConfigHttp   `json:"http"`
+	Retries     *int         `json:"retries"`
+	RetryPause  *int         `json:"retry-pause"`
+	Verbose     int          `json:"verbose"`
+	LogFile     *string      `json:"log-file"` // null is no log file, see flags
+	UserAgent   string       `json:"user-agent"`
+	DonateLevel *int         `json:"donate-level"`
+
+	// go-cpuminer only
+	LogLevel    string            `json:"log-level"` // read once at start, a reload only warns it needs a restart
+	Proxy       string            `json:"proxy"`
+	Probe       *int              `json:"probe"`
+	MaxRetries  *int              `json:"max-retries"`
+	BackoffMax  *int              `json:"backoff-max"`
+	WaitPool    *bool             `json:"wait-pool"`
+	SubmitStale *bool             `json:"submit-stale"`
+	StateFile   string            `json:"state-file"`
+	OnError     map[string]string `json:"on-error"` // pool error kind to reaction, see -onerror
+}
+
+type ConfigPool struct {
+	Url            string `json:"url"`
+	User           string `json:"user"`
+	Pass           string `json:"pass"`
+	RigId          string `json:"rig-id"`
+	Algo           string `json:"algo"`
+	Tls            bool   `json:"tls"`
+	TlsFingerprint string `json:"tls-fingerprint"`
+	Daemon         bool   `json:"daemon"`
+	Enabled        *bool  `json:"enabled"`
+
+	// go-cpuminer only
+	Protocol string `json:"protocol"`
+}
+
+type ConfigCpu struct {
+	Enabled        *bool `json:"enabled"`
+	MaxThreadsHint int   `json:"max-threads-hint"`
+
+	// go-cpuminer only, xmrig derives the count from its per algo profiles
+	Threads  int   `json:"threads"`
+	Affinity []int `json:"affinity"` // cpus the threads are pinned to in turn
+}
+
+type ConfigHttp struct {
+	Enabled     bool   `json:"enabled"`
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	AccessToken string `json:"access-token"`
+}
+
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad config "+file)
+	}
+
+	if c.Cpu.Enabled != nil && !*c.Cpu.Enabled {
+		return nil, errors.New("cpu is disabled in " + file)
+	}
+
+	return c, nil
+}
+
+// threads picks the thread count, an explicit count wins over xmrig's percent of cores hint,
+// 0 when the config has neither and -thread keeps its default
+func (c *Config) threads() int {
+	if c.Cpu.Threads > 0 {
+		return c.Cpu.Threads
+	}
+	if c.Cpu.MaxThreadsHint >= 100 {
+		return runtime.NumCPU()
+	}
+	if c.Cpu.MaxThreadsHint > 0 {
+		n := runtime.NumCPU() * c.Cpu.MaxThreadsHint / 100
+		if n < 1 {
+			n = 1
+		}
+		return n
+	}
+	return 0
+}
+
+// flags turns the config into flag values, main only takes the ones not given on the command line
+func (c *Config) flags() map[string]string {
+	f := make(map[string]string)
+
+	if n := c.threads(); n > 0 {
+		f["thread"] = strconv.Itoa(n)
+	}
+
+	if c.Retries != nil {
+		f["retries"] = strconv.Itoa(*c.Retries)
+	}
+	if c.RetryPause != nil {
+		f["backoff"] = strconv.Itoa(*c.RetryPause)
+	}
+	if c.Probe != nil {
+		f["probe"] = strconv.Itoa(*c.Probe)
+	}
+	if c.MaxRetries != nil {
+		f["maxretries"] = strconv.Itoa(*c.MaxRetries)
+	}
+	if c.BackoffMax != nil {
+		f["backoffmax"] = strconv.Itoa(*c.BackoffMax)
+	}
+	if c.WaitPool != nil && *c.WaitPool {
+		f["waitpool"] = "1"
+	}
+	if c.SubmitStale != nil && *c.SubmitStale {
+		f["submitstale"] = "1"
+	}
+	if len(c.OnError) > 0 {
+		f["onerror"] = formatReactions(c.OnError)
+	}
+	if c.Proxy != "" {
+		f["proxy"] = c.Proxy
+	}
+	if len(c.Cpu.Affinity) > 0 {
+		var cpus []string
+		for _, cpu := range c.Cpu.Affinity {
+			cpus = append(cpus, strconv.Itoa(cpu))
+		}
+		f["affinity"] = strings.Join(cpus, ",")
+	}
+	if c.StateFile != "" {
+		f["state"] = c.StateFile
+	}
+	if c.UserAgent != "" {
+		f["agent"] = c.UserAgent
+	}
+
+	if c.LogLevel != "" {
+		f["loglevel"] = c.LogLevel
+	} else if c.Verbose > 0 {
+		f["loglevel"] = "debug"
+	}
+	// like xmrig, no log-file or null logs to the console only. loggo can't write to a given path,
+	// any path turns on its daily files gocpuminer_<level>_<date>.log in the working dir
+	if c.LogFile == nil || *c.LogFile == "" {
+		f["nolog"] = "1"
+	}
+
+	if c.Http.Enabled {
+		host := c.Http.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		f["api"] = host + ":" + strconv.Itoa(c.Http.Port)
+		if c.Http.AccessToken != "" {
+			f["apitoken"] = c.Http.AccessToken
+		}
+	}
+
+	return f
+}
+
+// apply sets every flag the command line did not set from the config
+func (c *Config) apply(set map[string]bool) error {
+	for name, value := range c.flags() {
+		if set[name] {
+			continue
+		}
+		err := flag.Set(name, value)
+		if err != nil {
+			return errors.Wrap(err, "config "+name)
+		}
+	}
+	return nil
+}
+
+// pools builds the failover list from the enabled pools
+func (c *Config) pools(set map[string]bool, user, pass, algo, proto, tlsfp string) ([]*Pool, error) {
+	specs := c.poolSpecs(set, user, pass, algo, proto, tlsfp)
+	if len(specs) == 0 {
+		return nil, errors.New("no enabled pool in config")
+	}
+
+	var pools []*Pool
+	for _, spec := range specs {
+		p, err := spec.newPool()
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// poolSpecs lists the enabled pools, user/pass/algo/proto/tlsfp given on the command line replace the file values
+func (c *Config) poolSpecs(set map[string]bool, user, pass, algo, proto, tlsfp string) []ConfigPool {
+	var specs []ConfigPool
+	for _, cp := range c.Pools {
+		if cp.Enabled != nil && !*cp.Enabled {
+			continue
+		}
+		if set["user"] {
+			cp.User = user
+		}
+		if set["pass"] {
+			cp.Pass = pass
+		}
+		if set["algo"] {
+			cp.Algo = algo
+		}
+		if set["proto"] {
+			cp.Protocol = proto
+		}
+		if set["tlsfp"] {
+			cp.TlsFingerprint = tlsfp
+		}
+		if cp.Daemon && !strings.Contains(cp.Url, "://") {
+			scheme := "daemon://"
+			if cp.Tls {
+				scheme = "daemon+https://"
+			}
+			cp.Url = scheme + cp.Url
+		}
+		specs = append(specs, cp)
+	}
+	return specs
+}
+
+func (cp *ConfigPool) newPool() (*Pool, error) {
+	p, err := NewPool(cp.Url, cp.Algo, cp.User, cp.Pass, cp.Tls, cp.TlsFingerprint, cp.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	p.rigid = cp.RigId
+	return p, nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestConfigFlags(t *testing.T) {
+	all := strconv.Itoa(runtime.NumCPU())
+	half := runtime.NumCPU() / 2
+	if half < 1 {
+		half = 1
+	}
+	tests := []struct {
+		name   string
+		json   string
+		thread string // empty keeps -thread
+		nolog  string
+	}{
+		{"empty", `{}`, "", "1"},
+		{"threads", `{"cpu":{"threads":3},"log-file":"miner.log"}`, "3", ""},
+		{"threads over hint", `{"cpu":{"threads":3,"max-threads-hint":50}}`, "3", "1"},
+		{"hint", `{"cpu":{"max-threads-hint":50}}`, strconv.Itoa(half), "1"},
+		{"full hint", `{"cpu":{"max-threads-hint":100}}`, all, "1"},
+		{"log-file null", `{"log-file":null}`, "", "1"},
+		{"log-file empty", `{"log-file":""}`, "", "1"},
+	}
+	for _, tt := range tests {
+		var c Config
+		if err := json.Unmarshal([]byte(tt.json), &c); err != nil {
+			t.Fatal(err)
+		}
+		f := c.flags()
+		if f["thread"] != tt.thread || f["nolog"] != tt.nolog {
+			t.Errorf("%v: thread %q nolog %q, want %q %q", tt.name, f["thread"], f["nolog"], tt.thread, tt.nolog)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kDaemonPollInterval = time.Second
+	kDaemonRefresh      = time.Minute
+	kDaemonKeepJobs     = 4
+)
+
+// Daemon mines solo, polling get_block_template from a monerod compatible json rpc and calling submit_block
+type Daemon struct {
+	pools     []*Pool
+	cur       int
+	fails     int
+	cfg       StratumConfig
+	status    int32
+	sequence  int32
+	probing   int32
+	pinned    bool // picked by hand, don't probe back to the primary
+	lastProbe time.Time
+	client    *http.Client
+	lock      sync.Mutex
+	err       error // why the last poll failed
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{} // closed when loop returns
+
+	jobs      chan *Job
+	lastPrev  string // under lock, a switch clears it so the next poll sends a job
+	lastTime  time.Time
+	templates sync.Map
+	order     []string
+
+	stat *Stat
+}
+
+func NewDaemon(pools []*Pool, cfg StratumConfig, jobs chan *Job, stat *Stat) (*Daemon, error) {
+	d := &Daemon{}
+	d.pools = pools
+	d.cfg = cfg
+	d.jobs = jobs
+	d.stat = stat
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.done = make(chan struct{})
+	d.lastProbe = time.Now()
+
+	if d.cfg.retries <= 0 {
+		d.cfg.retries = 1
+	}
+
+	err := checkPoolList(pools, true)
+	if err != nil {
+		return nil, err
+	}
+
+	d.client = &http.Client{
+		Timeout: kDialTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialPool(d.cfg.proxy, addr, false, "")
+			},
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialPool(d.cfg.proxy, addr, true, d.fingerprint(addr))
+			},
+		},
+	}
+
+	for i := range d.pools {
+		d.cur = i
+		err = d.poll()
+		if err == nil {
+			break
+		}
+		loggo.Warn("Daemon New fail %v %v", d.current(), err)
+	}
+	if err != nil {
+		d.cur = 0
+		if !d.cfg.background {
+			loggo.Error("Daemon New fail %v", err)
+			return nil, err
+		}
+		loggo.Warn("Daemon New fail %v, keep retrying in background", err)
+		d.err = err
+		d.setState(STRATUM_DISCONNECTED)
+	}
+
+	go d.loop()
+
+	loggo.Info("Daemon New ok %v", d.current())
+
+	return d, nil
+}
+
+func (d *Daemon) current() *Pool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.pools[d.cur]
+}
+
+// fingerprint is the pinned certificate of the daemon at addr, the probe dials the primary while another is current
+func (d *Daemon) fingerprint(addr string) string {
+	for _, pool := range d.poolList() {
+		if pool.host == addr {
+			return pool.tlsfp
+		}
+	}
+	return ""
+}
+
+// switchPool moves to another daemon, the next poll sends a fresh job from it
+func (d *Daemon) switchPool(index int) {
+	d.lock.Lock()
+	old := d.pools[d.cur]
+	d.cur = index
+	d.fails = 0
+	d.lastPrev = ""
+	d.lastProbe = time.Now()
+	d.lock.Unlock()
+	loggo.Warn("Daemon switch pool %v -> %v", old, d.current())
+}
+
+func (d *Daemon) failover() {
+	d.lock.Lock()
+	next := (d.cur + 1) % len(d.pools)
+	d.pinned = false
+	d.lock.Unlock()
+	d.switchPool(next)
+	d.stat.addReconnect()
+}
+
+func (d *Daemon) poolList() []*Pool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.pools
+}
+
+// usePool moves to a daemon picked by hand, the primary is not probed until this one fails
+func (d *Daemon) usePool(index int) error {
+	d.lock.Lock()
+	if index < 0 || index >= len(d.pools) {
+		d.lock.Unlock()
+		return errors.New("no pool " + strconv.Itoa(index))
+	}
+	d.pinned = index != 0
+	same := index == d.cur
+	d.lock.Unlock()
+	if !same {
+		d.switchPool(index)
+	}
+	return nil
+}
+
+// setPools takes a reloaded daemon list, submit_block is answered in the same request so nothing is in flight
+func (d *Daemon) setPools(pools []*Pool) error {
+	err := checkPoolList(pools, true)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	old := d.pools[d.cur]
+	cur := reselect(pools, old, d.cur)
+	d.pools = pools
+	d.fails = 0
+	if cur >= 0 {
+		d.cur = cur
+		d.lock.Unlock()
+		loggo.Info("Daemon pools reloaded, %v pools, keep %v", len(pools), old)
+		return nil
+	}
+	d.cur = 0
+	d.pinned = false
+	d.lastPrev = ""
+	d.lastProbe = time.Now()
+	d.lock.Unlock()
+	loggo.Warn("Daemon pools reloaded, %v pools, switch %v -> %v", len(pools), old, pools[0])
+	return nil
+}
+
+func (d *Daemon) lastError() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.err
+}
+
+func (d *Daemon) state() int32 {
+	return atomic.LoadInt32(&d.status)
+}
+
+func (d *Daemon) stateName() string {
+	switch d.state() {
+	case STRATUM_CONNECTED:
+		return "connected"
+	case STRATUM_DISCONNECTED:
+		return "disconnected"
+	case STRATUM_STOPPED:
+		return "stopped"
+	}
+	return "connecting"
+}
+
+func (d *Daemon) setState(state int32) {
+	old := atomic.SwapInt32(&d.status, state)
+	if old != state && state == STRATUM_DISCONNECTED && d.ctx.Err() == nil {
+		d.jobs <- nil
+	}
+}
+
+func (d *Daemon) loop() {
+	defer common.CrashLog()
+	defer close(d.done)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(kDaemonPollInterval):
+		}
+
+		err := d.poll()
+		d.lock.Lock()
+		d.err = err
+		if err != nil {
+			d.fails++
+		} else {
+			d.fails = 0
+		}
+		failover := d.fails >= d.cfg.retries && len(d.pools) > 1
+		d.lock.Unlock()
+		if err != nil {
+			loggo.Error("Daemon poll fail %v %v", d.current(), err)
+			d.setState(STRATUM_DISCONNECTED)
+			if failover {
+				d.failover()
+			}
+		}
+	}
+}
+
+func (d *Daemon) call(pool *Pool, method string, params interface{}, result interface{}) error {
+	req := JSONRpcReq{
+		Id:      int(atomic.AddInt32(&d.sequence, 1)),
+		Method:  method,
+		JsonRPC: "2.0",
+		Params:  params,
+	}
+	reqm, err := json.Marshal(&req)
+	if err != nil {
+		return err
+	}
+
+	scheme := "http://"
+	if pool.tls {
+		scheme = "https://"
+	}
+	rsp, err := d.client.Post(scheme+pool.host+"/json_rpc", "application/json", bytes.NewReader(reqm))
+	if err != nil {
+		return &DialError{Pool: pool.url, Err: err}
+	}
+	defer rsp.Body.Close()
+
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return &DialError{Pool: pool.url, Err: err}
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return &ProtocolError{Pool: pool.url, Err: errors.New("daemon http status " + rsp.Status)}
+	}
+
+	loggo.Debug("Daemon recv %v %v", method, string(body))
+
+	var r DaemonRsp
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return &ProtocolError{Pool: pool.url, Err: err}
+	}
+	if r.Error != nil {
+		return &ProtocolError{Pool: pool.url, Err: errors.New(r.Error.Message + " code " + strconv.Itoa(r.Error.Code))}
+	}
+	if r.Result == nil {
+		return &ProtocolError{Pool: pool.url, Err: errors.New("daemon " + method + " no result")}
+	}
+	return json.Unmarshal(*r.Result, result)
+}
+
+func (d *Daemon) template(pool *Pool) (*BlockTemplateReply, error) {
+	var t BlockTemplateReply
+	err := d.call(pool, "get_block_template", &BlockTemplateParam{WalletAddress: pool.user}, &t)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != "" && t.Status != "OK" {
+		return nil, &ProtocolError{Pool: pool.url, Err: errors.New("get_block_template status " + t.Status)}
+	}
+	return &t, nil
+}
+
+func (d *Daemon) poll() error {
+	pool := d.current()
+
+	t, err := d.template(pool)
+	if err != nil {
+		return err
+	}
+
+	d.setState(STRATUM_CONNECTED)
+
+	// the template also changes with every new mempool tx, only restart workers on a new block or once in a while
+	d.lock.Lock()
+	same := t.PrevHash == d.lastPrev && time.Now().Sub(d.lastTime) < kDaemonRefresh
+	d.lock.Unlock()
+	if same {
+		return nil
+	}
+
+	j := &Job{
+		algorithm: pool.algo,
+		id:        strconv.FormatUint(t.Height, 10) + "-" + strconv.Itoa(int(atomic.LoadInt32(&d.sequence))),
+		height:    t.Height,
+		diff:      float64(t.Difficulty),
+	}
+
+	if !j.setBlob(t.BlockhashingBlob) {
+		return errors.New("bad blockhashing_blob " + t.BlockhashingBlob)
+	}
+	j.nicehash = false
+
+	if t.Difficulty == 0 {
+		return errors.New("zero difficulty")
+	}
+	j.target = 0xFFFFFFFFFFFFFFFF / t.Difficulty
+
+	if j.algorithm.family() == RANDOM_X {
+		if !j.setSeedHash(t.SeedHash) {
+			return errors.New("bad seed_hash " + t.SeedHash)
+		}
+	}
+
+	ok, template := fromHex(t.BlocktemplateBlob)
+	if !ok || len(template) < j.nonceOffset()+j.nonceSize() {
+		return errors.New("bad blocktemplate_blob")
+	}
+	d.templates.Store(j.id, template)
+	d.order = append(d.order, j.id)
+	if len(d.order) > kDaemonKeepJobs {
+		d.templates.Delete(d.order[0])
+		d.order = d.order[1:]
+	}
+
+	d.lock.Lock()
+	d.lastPrev = t.PrevHash
+	d.lastTime = time.Now()
+	d.lock.Unlock()
+
+	d.jobs <- j
+	d.stat.addJob()
+
+	loggo.Info("Daemon new job id=%v algo=%v height=%v diff=%v prev=%v", j.id, j.algorithm.name(), j.height, j.diff, t.PrevHash)
+
+	return nil
+}
+
+func (d *Daemon) submit(result *JobResult) {
+	d.stat.addSubmit()
+
+	v, ok := d.templates.Load(result.job.id)
+	if !ok {
+		d.stat.addResult("template expired")
+		loggo.Error("Daemon submit template gone %v", result.job.id)
+		return
+	}
+
+	// the hashing blob and the block share the header, so the nonce sits at the same offset
+	template := append([]byte{}, v.([]byte)...)
+	binary.LittleEndian.PutUint32(template[result.job.nonceOffset():], result.nonce)
+
+	loggo.Warn("Daemon submit block height=%v nonce=%v", result.job.height, result.nonce)
+
+	result.submit = time.Now()
+	var r SubmitBlockReply
+	err := d.call(d.current(), "submit_block", []string{hex.EncodeToString(template)}, &r)
+	d.stat.setLatency(time.Now().Sub(result.submit))
+	if err != nil || (r.Status != "" && r.Status != "OK") {
+		var perr *ProtocolError
+		if errors.As(err, &perr) {
+			d.stat.addPoolError(classifyPoolError(perr.Err.Error()))
+		}
+		d.stat.addResult("submit_block fail " + r.Status)
+		loggo.Error("Daemon submit block fail %v %v %v", result.job.id, r.Status, err)
+		return
+	}
+
+	d.stat.addResult("")
+	loggo.Warn("Daemon submit block OK %v %v", result.job.id, time.Now().Sub(result.submit))
+}
+
+// stop ends polling, submit_block is answered in submit already so nothing is in flight
+func (d *Daemon) stop(deadline time.Time) {
+	d.cancel()
+	select {
+	case <-d.done:
+	case <-time.After(deadline.Sub(time.Now())):
+		loggo.Warn("Daemon poll still running")
+	}
+	d.setState(STRATUM_STOPPED)
+	loggo.Info("Daemon stopped %v", d.current())
+}
+
+func (d *Daemon) hb() {
+	d.probePrimary()
+}
+
+// probePrimary asks the primary daemon for a block template every cfg.probe after failover and moves back once it answers
+func (d *Daemon) probePrimary() {
+	d.lock.Lock()
+	need := d.cur != 0 && !d.pinned && d.cfg.probe > 0 && time.Now().Sub(d.lastProbe) > d.cfg.probe
+	if need {
+		d.lastProbe = time.Now()
+	}
+	d.lock.Unlock()
+
+	if !need || !atomic.CompareAndSwapInt32(&d.probing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer common.CrashLog()
+		defer atomic.StoreInt32(&d.probing, 0)
+
+		primary := d.poolList()[0]
+		_, err := d.template(primary)
+		if err != nil {
+			loggo.Info("Daemon probe primary pool %v fail %v", primary, err)
+			return
+		}
+
+		loggo.Warn("Daemon primary pool %v is back, switch to it", primary)
+		d.switchPool(0)
+	}()
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testDaemonBlob   = "1010f1c2eb830614c310e956721ef3e47e882d077c2d2f161a9a2ae5567419b4d7b54e40d5800a0000000070b340380900000020123822000000000000000000000000000000000000000000000000000000000000000000000000308f1744ee050000c06891b8c3000000000000000000000000000000000000000000000000000000"
+	testDaemonWallet = "44AFFq5kSiGBoZ4NMDwYtN18obc8AemS33DBLWs3H7otXft3XjrpDtQGv7SqSsaBYBb98uNbr2VBBEt7f2wfn3RVGQBEP3A"
+)
+
+// testDaemon is a monerod json rpc answering get_block_template and recording submit_block
+type testDaemon struct {
+	server *httptest.Server
+	down   int32 // answer every call with 500
+
+	lock    sync.Mutex
+	wallet  string
+	blocks  []string
+	status  string // submit_block status, empty is OK
+	polls   int
+	submits int
+}
+
+func newTestDaemon(t *testing.T) *testDaemon {
+	d := &testDaemon{}
+	d.server = httptest.NewServer(http.HandlerFunc(d.serve))
+	t.Cleanup(d.server.Close)
+	return d
+}
+
+func (d *testDaemon) url() string {
+	return "daemon://" + strings.TrimPrefix(d.server.URL, "http://")
+}
+
+func (d *testDaemon) serve(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&d.down) != 0 || r.URL.Path != "/json_rpc" {
+		http.Error(w, "down", http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		Id     int             `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	d.lock.Lock()
+	var result interface{}
+	switch req.Method {
+	case "get_block_template":
+		var p BlockTemplateParam
+		json.Unmarshal(req.Params, &p)
+		d.wallet = p.WalletAddress
+		d.polls++
+		result = &BlockTemplateReply{
+			BlocktemplateBlob: testDaemonBlob + "00",
+			BlockhashingBlob:  testDaemonBlob,
+			Difficulty:        1000,
+			Height:            100,
+			PrevHash:          "aa",
+			Status:            "OK",
+		}
+	case "submit_block":
+		var p []string
+		json.Unmarshal(req.Params, &p)
+		d.blocks = append(d.blocks, p...)
+		d.submits++
+		status := d.status
+		if status == "" {
+			status = "OK"
+		}
+		result = &SubmitBlockReply{Status: status}
+	}
+	d.lock.Unlock()
+
+	m, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(&DaemonRsp{Id: req.Id, Version: "2.0", Result: (*json.RawMessage)(&m)})
+}
+
+func newTestDaemonClient(t *testing.T, cfg StratumConfig, daemons ...*testDaemon) (*Daemon, chan *Job, *Stat) {
+	var pools []*Pool
+	for _, td := range daemons {
+		pool, err := NewPool(td.url(), "cn/0", testDaemonWallet, "", false, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pools = append(pools, pool)
+	}
+	jobs := make(chan *Job, 16)
+	stat := &Stat{}
+	d, err := NewDaemon(pools, cfg, jobs, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.stop(time.Now().Add(time.Second)) })
+	return d, jobs, stat
+}
+
+func nextJob(t *testing.T, jobs chan *Job) *Job {
+	for {
+		select {
+		case j := <-jobs:
+			if j != nil {
+				return j
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("no job")
+		}
+	}
+}
+
+func TestDaemonTemplateToSubmit(t *testing.T) {
+	td := newTestDaemon(t)
+	d, jobs, stat := newTestDaemonClient(t, StratumConfig{}, td)
+
+	j := nextJob(t, jobs)
+	if j.height != 100 || j.diff != 1000 || j.target != 0xFFFFFFFFFFFFFFFF/1000 {
+		t.Errorf("job height %v diff %v target %x", j.height, j.diff, j.target)
+	}
+	if hex.EncodeToString(j.blob[:j.size]) != testDaemonBlob {
+		t.Errorf("job blob %x", j.blob[:j.size])
+	}
+	td.lock.Lock()
+	wallet := td.wallet
+	td.lock.Unlock()
+	if wallet != testDaemonWallet {
+		t.Errorf("get_block_template wallet %v", wallet)
+	}
+	if d.stateName() != "connected" {
+		t.Errorf("state %v", d.stateName())
+	}
+
+	const nonce = 0x11223344
+	d.submit(&JobResult{job: j, nonce: nonce})
+
+	td.lock.Lock()
+	blocks := td.blocks
+	td.lock.Unlock()
+	if len(blocks) != 1 {
+		t.Fatalf("submit_block got %v blocks", len(blocks))
+	}
+	block, err := hex.DecodeString(blocks[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, _ := hex.DecodeString(testDaemonBlob + "00")
+	if len(block) != len(template) {
+		t.Fatalf("block size %v, want the template size %v", len(block), len(template))
+	}
+	if got := binary.LittleEndian.Uint32(block[j.nonceOffset():]); got != nonce {
+		t.Errorf("block nonce %x, want %x", got, nonce)
+	}
+	binary.LittleEndian.PutUint32(template[j.nonceOffset():], nonce)
+	if hex.EncodeToString(block) != hex.EncodeToString(template) {
+		t.Error("block differs from the template outside the nonce")
+	}
+
+	snap := stat.snapshot()
+	if snap.submitted != 1 || snap.accepted != 1 || snap.invalid != 0 {
+		t.Errorf("submitted %v accepted %v invalid %v", snap.submitted, snap.accepted, snap.invalid)
+	}
+}
+
+func TestDaemonSubmitRejected(t *testing.T) {
+	td := newTestDaemon(t)
+	td.status = "BUSY"
+	d, jobs, stat := newTestDaemonClient(t, StratumConfig{}, td)
+
+	d.submit(&JobResult{job: nextJob(t, jobs), nonce: 1})
+	// a job the daemon no longer keeps a template for is never sent and counts as stale
+	d.submit(&JobResult{job: &Job{id: "gone", algorithm: NewAlgorithm("cn/0")}, nonce: 1})
+
+	td.lock.Lock()
+	submits := td.submits
+	td.lock.Unlock()
+	if submits != 1 {
+		t.Errorf("submit_block called %v times", submits)
+	}
+	snap := stat.snapshot()
+	if snap.submitted != 2 || snap.accepted != 0 || snap.stale != 1 || snap.invalid != 1 {
+		t.Errorf("submitted %v accepted %v stale %v invalid %v", snap.submitted, snap.accepted, snap.stale, snap.invalid)
+	}
+}
+
+func TestDaemonProbePrimary(t *testing.T) {
+	primary := newTestDaemon(t)
+	backup := newTestDaemon(t)
+	atomic.StoreInt32(&primary.down, 1)
+
+	d, jobs, _ := newTestDaemonClient(t, StratumConfig{probe: time.Millisecond}, primary, backup)
+	nextJob(t, jobs)
+	if d.current().url != backup.url() {
+		t.Fatalf("started on %v, want the backup", d.current())
+	}
+
+	// down, the probe keeps the backup
+	time.Sleep(time.Millisecond * 5)
+	d.hb()
+	time.Sleep(time.Millisecond * 100)
+	if d.current().url != backup.url() {
+		t.Fatalf("moved to %v while the primary is down", d.current())
+	}
+
+	atomic.StoreInt32(&primary.down, 0)
+	deadline := time.Now().Add(time.Second * 5)
+	for d.current().url != primary.url() {
+		if time.Now().After(deadline) {
+			t.Fatal("never moved back to the primary")
+		}
+		time.Sleep(time.Millisecond * 10)
+		d.hb()
+	}
+
+	// the next poll sends a job from the primary
+	nextJob(t, jobs)
+	primary.lock.Lock()
+	polls := primary.polls
+	primary.lock.Unlock()
+	if polls < 2 {
+		t.Errorf("primary polled %v times, want the probe and a poll", polls)
+	}
+}
+
+func TestDaemonPinnedNotProbed(t *testing.T) {
+	primary := newTestDaemon(t)
+	backup := newTestDaemon(t)
+
+	d, jobs, _ := newTestDaemonClient(t, StratumConfig{probe: time.Millisecond}, primary, backup)
+	nextJob(t, jobs)
+	if err := d.usePool(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 5)
+		d.hb()
+	}
+	time.Sleep(time.Millisecond * 100)
+	if d.current().url != backup.url() {
+		t.Errorf("a pool picked by hand was left for %v", d.current())
+	}
+	if err := d.usePool(2); err == nil {
+		t.Error("usePool out of range succeeded")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	kDialTimeout = time.Second * 10
+)
+
+// parsePoolUrl accepts host:port or stratum+tcp://, stratum+ssl://, stratum+tls://, daemon://, daemon+https:// urls
+func parsePoolUrl(server string) (string, bool, bool, error) {
+	host := server
+	tls := false
+	daemon := false
+	if i := strings.Index(server, "://"); i >= 0 {
+		scheme := strings.ToLower(server[:i])
+		host = server[i+3:]
+		switch scheme {
+		case "stratum+tcp", "tcp":
+		case "stratum+ssl", "stratum+tls", "ssl", "tls":
+			tls = true
+		case "daemon", "daemon+http":
+			daemon = true
+		case "daemon+https":
+			daemon = true
+			tls = true
+		default:
+			return "", false, false, errors.New("unknown pool url scheme " + scheme)
+		}
+	}
+	host = strings.TrimSuffix(host, "/")
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return "", false, false, errors.Wrap(err, "invalid pool addr "+server)
+	}
+	return host, tls, daemon, nil
+}
+
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+}
+
+func tlsFingerprint(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func parseProxyUrl(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid proxy "+proxy)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, errors.New("unknown proxy scheme " + u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return nil, errors.Wrap(err, "invalid proxy addr "+proxy)
+	}
+	return u, nil
+}
+
+func dialPool(proxy *url.URL, host string, useTls bool, fingerprint string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy != nil {
+		conn, err = dialProxy(proxy, host)
+	} else {
+		conn, err = net.DialTimeout("tcp", host, kDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !useTls {
+		return conn, nil
+	}
+
+	// pools mostly use self-signed certs, so trust is established by the fingerprint instead of a CA
+	name, _, _ := net.SplitHostPort(host)
+	tconn := tls.Client(conn, &tls.Config{
+		ServerName:         name,
+		InsecureSkipVerify: true,
+	})
+	tconn.SetDeadline(time.Now().Add(kDialTimeout))
+	err = tconn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "tls handshake fail")
+	}
+	tconn.SetDeadline(time.Time{})
+
+	fp := tlsFingerprint(tconn)
+	state := tconn.ConnectionState()
+	loggo.Info("Stratum tls ok %v version=%x cipher=%v fingerprint=%v", host, state.Version,
+		tls.CipherSuiteName(state.CipherSuite), fp)
+
+	if fingerprint != "" && normalizeFingerprint(fingerprint) != fp {
+		tconn.Close()
+		loggo.Error("Stratum tls fingerprint mismatch %v expected=%v got=%v", host, normalizeFingerprint(fingerprint), fp)
+		return nil, errors.New("tls fingerprint mismatch, expected " + normalizeFingerprint(fingerprint) + " got " + fp)
+	}
+
+	return tconn, nil
+}
+
+func dialProxy(proxy *url.URL, host string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Host, kDialTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial proxy fail")
+	}
+
+	conn.SetDeadline(time.Now().Add(kDialTimeout))
+	if strings.ToLower(proxy.Scheme) == "http" {
+		conn, err = httpConnect(conn, proxy, host)
+	} else {
+		err = socks5Connect(conn, proxy, host)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	loggo.Info("Stratum proxy connect ok %v -> %v", proxy.Host, host)
+
+	return conn, nil
+}
+
+func socks5Connect(conn net.Conn, proxy *url.URL, host string) error {
+	user := proxy.User.Username()
+	pass, _ := proxy.User.Password()
+
+	if user != "" {
+		_, err := conn.Write([]byte{5, 2, 0, 2})
+		if err != nil {
+			return errors.Wrap(err, "socks5 write greeting fail")
+		}
+	} else {
+		_, err := conn.Write([]byte{5, 1, 0})
+		if err != nil {
+			return errors.Wrap(err, "socks5 write greeting fail")
+		}
+	}
+
+	var buf [2]byte
+	_, err := io.ReadFull(conn, buf[:])
+	if err != nil {
+		return errors.Wrap(err, "socks5 read greeting fail")
+	}
+	if buf[0] != 5 {
+		return errors.New("socks5 unexpected version " + strconv.Itoa(int(buf[0])))
+	}
+
+	switch buf[1] {
+	case 0:
+	case 2:
+		if user == "" || len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5 proxy requires authentication")
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return errors.Wrap(err, "socks5 write auth fail")
+		}
+		_, err = io.ReadFull(conn, buf[:])
+		if err != nil {
+			return errors.Wrap(err, "socks5 read auth fail")
+		}
+		if buf[1] != 0 {
+			return errors.New("socks5 authentication rejected")
+		}
+	default:
+		return errors.New("socks5 no acceptable auth method")
+	}
+
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return errors.Wrap(err, "socks5 invalid port "+p)
+	}
+	if len(h) > 255 {
+		return errors.New("socks5 host too long " + h)
+	}
+
+	// let the proxy resolve the pool name, the rig may have no dns at all
+	req := []byte{5, 1, 0, 3, byte(len(h))}
+	req = append(req, h...)
+	req = append(req, byte(port>>8), byte(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return errors.Wrap(err, "socks5 write connect fail")
+	}
+
+	var rsp [4]byte
+	_, err = io.ReadFull(conn, rsp[:])
+	if err != nil {
+		return errors.Wrap(err, "socks5 read connect fail")
+	}
+	if rsp[1] != 0 {
+		return errors.New("socks5 connect fail code " + strconv.Itoa(int(rsp[1])))
+	}
+
+	var skip int
+	switch rsp[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		_, err = io.ReadFull(conn, buf[:1])
+		if err != nil {
+			return errors.Wrap(err, "socks5 read bind addr fail")
+		}
+		skip = int(buf[0])
+	default:
+		return errors.New("socks5 unknown bind addr type " + strconv.Itoa(int(rsp[3])))
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	if err != nil {
+		return errors.Wrap(err, "socks5 read bind addr fail")
+	}
+
+	return nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, host string) (net.Conn, error) {
+	req := "CONNECT " + host + " HTTP/1.1\r\nHost: " + host + "\r\n"
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+
+	_, err := conn.Write([]byte(req))
+	if err != nil {
+		return conn, errors.Wrap(err, "http proxy write fail")
+	}
+
+	reader := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return conn, errors.Wrap(err, "http proxy read fail")
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return conn, errors.New("http proxy connect fail " + rsp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		return &bufferedConn{conn, reader}, nil
+	}
+	return conn, nil
+}
@@ -5,11 +5,11 @@ go 1.24.4
 require (
 	github.com/esrrhs/gohome v0.0.0-20250817065232-0c1b36efd742
 	github.com/pkg/errors v0.9.1
+	golang.org/x/sys v0.35.0
 )
 
 require (
 	github.com/OneOfOne/xxhash v1.2.8 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	golang.org/x/sys v0.35.0 // indirect
 	google.golang.org/protobuf v1.36.7 // indirect
 )
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	kHashrateShort   = time.Second * 10
+	kHashrateMedium  = time.Minute
+	kHashrateLarge   = time.Minute * 15
+	kHashrateSamples = 1024 // one sample a second covers the 15 minute window
+)
+
+var kHashrateWindows = []time.Duration{kHashrateShort, kHashrateMedium, kHashrateLarge}
+var kHashrateWindowNames = []string{"10s", "60s", "15m"}
+
+type HashrateSample struct {
+	time   time.Time
+	hashes uint64
+}
+
+// HashrateRing keeps the latest samples of one thread's hash counter
+type HashrateRing struct {
+	samples [kHashrateSamples]HashrateSample
+	top     int
+	count   int
+}
+
+func (r *HashrateRing) add(now time.Time, hashes uint64) {
+	r.samples[r.top] = HashrateSample{time: now, hashes: hashes}
+	r.top = (r.top + 1) % kHashrateSamples
+	if r.count < kHashrateSamples {
+		r.count++
+	}
+}
+
+// calc divides the hashes done between the oldest sample inside the window and the latest one by the time between them
+func (r *HashrateRing) calc(window time.Duration) (float64, bool) {
+	if r.count < 2 {
+		return 0, false
+	}
+
+	latest := r.samples[(r.top-1+kHashrateSamples)%kHashrateSamples]
+	var earliest *HashrateSample
+	for i := 2; i <= r.count; i++ {
+		s := &r.samples[(r.top-i+kHashrateSamples)%kHashrateSamples]
+		if latest.time.Sub(s.time) > window {
+			break
+		}
+		earliest = s
+	}
+	if earliest == nil {
+		return 0, false
+	}
+
+	elapse := latest.time.Sub(earliest.time).Seconds()
+	if elapse <= 0 {
+		return 0, false
+	}
+	return float64(latest.hashes-earliest.hashes) / elapse, true
+}
+
+// Hashrate gives xmrig style 10s/60s/15m averages per thread and in total, built from timestamped hash counters
+type Hashrate struct {
+	threads []*HashrateRing
+	highest float64
+}
+
+func NewHashrate() *Hashrate {
+	return &Hashrate{}
+}
+
+func (h *Hashrate) resize(threads int) {
+	for len(h.threads) < threads {
+		h.threads = append(h.threads, &HashrateRing{})
+	}
+	h.threads = h.threads[:threads]
+}
+
+func (h *Hashrate) add(thread int, now time.Time, hashes uint64) {
+	h.threads[thread].add(now, hashes)
+}
+
+func (h *Hashrate) calc(thread int, window time.Duration) (float64, bool) {
+	return h.threads[thread].calc(window)
+}
+
+// total sums the threads that have enough samples
+func (h *Hashrate) total(window time.Duration) (float64, bool) {
+	var sum float64
+	valid := false
+	for _, r := range h.threads {
+		v, ok := r.calc(window)
+		if ok {
+			sum += v
+			valid = true
+		}
+	}
+	return sum, valid
+}
+
+func (h *Hashrate) updateHighest() {
+	v, ok := h.total(kHashrateShort)
+	if ok && v > h.highest {
+		h.highest = v
+	}
+}
+
+// windows returns the [10s, 60s, 15m] triple of a thread, -1 for the total, nil where there are not enough samples yet
+func (h *Hashrate) windows(thread int) []*float64 {
+	ret := make([]*float64, len(kHashrateWindows))
+	for i, window := range kHashrateWindows {
+		var v float64
+		var ok bool
+		if thread < 0 {
+			v, ok = h.total(window)
+		} else {
+			v, ok = h.calc(thread, window)
+		}
+		if ok {
+			ret[i] = &v
+		}
+	}
+	return ret
+}
+
+func formatRate(v *float64) string {
+	if v == nil {
+		return "n/a"
+	}
+	return strconv.FormatFloat(*v, 'f', 2, 64)
+}
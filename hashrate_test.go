@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testHashrateStart = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// fillRing adds a sample every step from start, the counter growing by rate a second
+func fillRing(r *HashrateRing, start time.Time, n int, step time.Duration, hashes uint64, rate uint64) (time.Time, uint64) {
+	for i := 0; i < n; i++ {
+		r.add(start, hashes)
+		start = start.Add(step)
+		hashes += rate * uint64(step/time.Second)
+	}
+	return start, hashes
+}
+
+func TestHashrateRing(t *testing.T) {
+	tests := []struct {
+		name   string
+		fill   func(r *HashrateRing)
+		window time.Duration
+		rate   float64
+		ok     bool
+	}{
+		{"empty", func(r *HashrateRing) {}, kHashrateShort, 0, false},
+		{"one sample", func(r *HashrateRing) { r.add(testHashrateStart, 10) }, kHashrateShort, 0, false},
+		{"no sample in window", func(r *HashrateRing) {
+			fillRing(r, testHashrateStart, 2, time.Second*20, 0, 100)
+		}, kHashrateShort, 0, false},
+		{"same time", func(r *HashrateRing) {
+			r.add(testHashrateStart, 0)
+			r.add(testHashrateStart, 10)
+		}, kHashrateShort, 0, false},
+		{"window longer than history", func(r *HashrateRing) {
+			fillRing(r, testHashrateStart, 5, time.Second, 0, 100)
+		}, kHashrateLarge, 100, true},
+		{"window", func(r *HashrateRing) {
+			next, hashes := fillRing(r, testHashrateStart, 60, time.Second, 0, 50)
+			fillRing(r, next, 11, time.Second, hashes, 200)
+		}, kHashrateShort, 200, true},
+		{"wraparound", func(r *HashrateRing) {
+			next, hashes := fillRing(r, testHashrateStart, kHashrateSamples, time.Second, 0, 50)
+			fillRing(r, next, 300, time.Second, hashes, 50)
+		}, kHashrateLarge, 50, true},
+		{"wraparound history shorter than window", func(r *HashrateRing) {
+			// 2 seconds a sample, the ring holds only the last 2048s but the window is 900s anyway
+			next, hashes := fillRing(r, testHashrateStart, kHashrateSamples, time.Second*2, 0, 10)
+			fillRing(r, next, 500, time.Second*2, hashes, 30)
+		}, kHashrateLarge, 30, true},
+	}
+	for _, tt := range tests {
+		r := &HashrateRing{}
+		tt.fill(r)
+		rate, ok := r.calc(tt.window)
+		if ok != tt.ok || rate != tt.rate {
+			t.Errorf("%v: got %v %v want %v %v", tt.name, rate, ok, tt.rate, tt.ok)
+		}
+		if r.count > kHashrateSamples {
+			t.Errorf("%v: count %v over the ring size", tt.name, r.count)
+		}
+	}
+}
+
+func TestHashrateTotal(t *testing.T) {
+	h := NewHashrate()
+	h.resize(3)
+	fillRing(h.threads[0], testHashrateStart, 11, time.Second, 0, 100)
+	fillRing(h.threads[1], testHashrateStart, 11, time.Second, 0, 20)
+	// the third thread just started, it has no rate yet and is left out
+
+	got := h.windows(-1)
+	for i, v := range got {
+		if v == nil || *v != 120 {
+			t.Errorf("total %v: %v want 120", kHashrateWindowNames[i], formatRate(v))
+		}
+	}
+	if w := h.windows(2); w[0] != nil || formatRate(w[0]) != "n/a" {
+		t.Errorf("thread without samples has rate %v", formatRate(w[0]))
+	}
+
+	h.updateHighest()
+	fillRing(h.threads[0], testHashrateStart.Add(time.Second*11), 11, time.Second, 1100, 10)
+	h.updateHighest()
+	if h.highest != 120 {
+		t.Errorf("highest %v want 120", h.highest)
+	}
+
+	h.resize(1)
+	if v, ok := h.total(kHashrateShort); !ok || v != 10 {
+		t.Errorf("total after resize %v %v want 10", v, ok)
+	}
+}
@@ -11,19 +11,30 @@ const (
 )
 
 type Job struct {
-	algorithm  *Algorithm
-	nicehash   bool
-	seed       []byte
-	size       int
-	clientId   string
-	extraNonce string
-	id         string
-	poolWallet string
-	backend    uint
-	diff       uint64
-	height     uint64
-	target     uint64
-	blob       [kMaxBlobSize]byte
+	algorithm   *Algorithm
+	nicehash    bool
+	seed        []byte
+	size        int
+	clientId    string
+	extraNonce  string
+	id          string
+	nonceOff    int // nonce offset of block header jobs, 0 uses the algorithm layout
+	extraNonce2 string
+	ntime       string
+	poolWallet  string
+	backend     uint
+	diff        float64 // stratum v1 pools send fractional difficulties
+	height      uint64
+	target      uint64
+	blob        [kMaxBlobSize]byte
+}
+
+// work tells apart jobs with their own nonce space, a stratum v1 job id comes again with the next extranonce2
+func (j *Job) work() string {
+	if j.extraNonce2 == "" {
+		return j.id
+	}
+	return j.id + "/" + j.extraNonce2
 }
 
 func (j *Job) setBlob(blob string) bool {
@@ -73,11 +84,15 @@ func (j *Job) setTarget(target string) bool {
 		j.target = binary.LittleEndian.Uint64(raw)
 	}
 
-	j.diff = toDiff(j.target)
+	j.diff = float64(toDiff(j.target))
 
 	return true
 }
 
+func (j *Job) checkHash(hash []byte) bool {
+	return binary.LittleEndian.Uint64(hash[24:]) < j.target
+}
+
 func (j *Job) setSeedHash(hash string) bool {
 
 	if hash == "" || len(hash) != kMaxSeedSize*2 {
@@ -94,6 +109,9 @@ func (j *Job) setSeedHash(hash string) bool {
 }
 
 func (j *Job) nonceOffset() int {
+	if j.nonceOff > 0 {
+		return j.nonceOff
+	}
 	if j.algorithm.family() == KAWPOW {
 		return 32
 	}
@@ -7,4 +7,5 @@ type JobResult struct {
 	nonce  uint32
 	hash   [32]byte
 	submit time.Time
+	done   func(err string) // called with the pool answer, empty err means accepted
 }
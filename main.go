@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
 	"net/http"
@@ -10,9 +11,11 @@ import (
 	"os/signal"
 	"runtime/pprof"
 	"strconv"
+	"syscall"
 	"time"
 )
 
+// Runner is what main runs, Stop only asks it to finish and Run returns once everything is closed
 type Runner interface {
 	Stop()
 	Run()
@@ -22,22 +25,64 @@ func main() {
 
 	defer common.CrashLog()
 
-	ty := flag.String("type", "miner", "miner/benchmark/test")
-	algo := flag.String("algo", "cn-heavy/xhv", "algo name")
-	username := flag.String("user", "hvxxwtgSqXaH9AZYYed9NbijK8hydEVtpb2k8SLv39ZrQxHacwP8QeeYriNunavkRf5fYbdf6BPj6g7yGmh2kS2i4toHRp4pdG", "username")
-	password := flag.String("pass", "x", "password")
-	server := flag.String("server", "pool.hashvault.pro:80", "pool server addr")
-	thread := flag.Int("thread", 1, "thread num")
+	config := flag.String("config", "", "xmrig style json config file, command line flags override it, pools and threads reload when it changes or on SIGHUP, log-level needs a restart")
+	ty := flag.String("type", "miner", "miner/solo/proxy/pool/benchmark/test/check-config/stats")
+	checktype := flag.String("checktype", "miner", "the -type check-config checks the options for, miner/solo/proxy")
+	algo := flag.String("algo", "cn-heavy/xhv", "algo name, comma separated per pool")
+	username := flag.String("user", "hvxxwtgSqXaH9AZYYed9NbijK8hydEVtpb2k8SLv39ZrQxHacwP8QeeYriNunavkRf5fYbdf6BPj6g7yGmh2kS2i4toHRp4pdG", "username, comma separated per pool")
+	password := flag.String("pass", "x", "password, comma separated per pool")
+	server := flag.String("server", "pool.hashvault.pro:80", "pool server addr, host:port or stratum+tcp:// stratum+ssl:// daemon:// url, comma separated failover list in priority order")
+	usetls := flag.Int("tls", 0, "use tls to connect pool")
+	tlsfp := flag.String("tlsfp", "", "pool tls certificate sha256 fingerprint, comma separated per pool")
+	proto := flag.String("proto", "stratum", "pool protocol stratum/stratum1, comma separated per pool")
+	retries := flag.Int("retries", 5, "failover to next pool after failed connects")
+	probe := flag.Int("probe", 300, "seconds between probing the primary pool after failover, 0 disable")
+	backoff := flag.Int("backoff", 1, "seconds before the first reconnect, doubled on every failure")
+	backoffmax := flag.Int("backoffmax", 60, "max seconds between reconnects")
+	proxy := flag.String("proxy", "", "connect pool through proxy, socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+	maxretries := flag.Int("maxretries", 0, "exit after reconnect failed times in a row, 0 retry forever")
+	onerror := flag.String("onerror", "", "reaction to pool errors, comma separated kind=reaction, kinds login/banned/unauthenticated/job-not-found/low-difficulty/duplicate/other, reactions ignore/relogin/switch/stop, default login=switch,banned=switch,unauthenticated=relogin")
+	waitpool := flag.Int("waitpool", 0, "keep retrying in background when no pool answers at startup, instead of exiting")
+	submitstale := flag.Int("submitstale", 0, "still submit shares of the previous job after a new one came, for pools that accept them")
+	thread := flag.Int("thread", 1, "thread num, -config cpu threads or max-threads-hint override it")
+	affinity := flag.String("affinity", "", "pin worker threads to these cpus in turn, like 0,2,4,6 or 0-3, linux only, empty no pinning")
+	api := flag.String("api", "", "http api listen addr, serves /1/summary /1/threads /1/config /metrics, miner and solo only, empty disable")
+	apitoken := flag.String("apitoken", "", "http api bearer token, empty no auth")
+	listen := flag.String("listen", ":3333", "proxy or stub pool listen addr for downstream miners")
+	jobs := flag.String("jobs", "", "stub pool json job list file, [{blob,target,algo,height,seed_hash}], empty serves the test blob")
+	jobtime := flag.Int("jobtime", 30, "seconds between stub pool jobs")
+	diff := flag.Uint64("diff", 0, "stub pool share difficulty, 0 use the job target")
+	agent := flag.String("agent", "", "user agent sent to the pool")
+	state := flag.String("state", "", "json file accumulating lifetime totals per pool and algo across restarts, -type stats prints it, empty disable")
 
 	nolog := flag.Int("nolog", 0, "write log file")
 	noprint := flag.Int("noprint", 0, "print stdout")
-	loglevel := flag.String("loglevel", "info", "log level")
+	loglevel := flag.String("loglevel", "info", "log level, read once at start, a -config reload does not change it")
 	profile := flag.Int("profile", 0, "open profile")
 	cpuprofile := flag.String("cpuprofile", "", "open cpuprofile")
 	memprofile := flag.String("memprofile", "", "open memprofile")
 
 	flag.Parse()
 
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var conf *Config
+	var confErr error
+	if *config != "" {
+		conf, confErr = LoadConfig(*config)
+		if confErr == nil {
+			confErr = conf.apply(set)
+		}
+	}
+
+	if *ty == "check-config" || *ty == "stats" {
+		// the report is the only output
+		*nolog = 1
+		*noprint = 1
+	}
+
 	level := loggo.LEVEL_INFO
 	if loggo.NameToLevel(*loglevel) >= 0 {
 		level = loggo.NameToLevel(*loglevel)
@@ -51,6 +96,53 @@ func main() {
 	})
 	loggo.Info("start...")
 
+	if *ty == "check-config" {
+		o := &CheckOptions{
+			mode:     *checktype,
+			config:   *config,
+			confErr:  confErr,
+			thread:   *thread,
+			affinity: *affinity,
+			proxy:    *proxy,
+			api:      *api,
+			apitoken: *apitoken,
+			onerror:  *onerror,
+		}
+		if conf != nil && len(conf.Pools) > 0 && !set["server"] {
+			o.pools = conf.poolSpecs(set, *username, *password, *algo, *proto, *tlsfp)
+		} else {
+			o.pools = flagPools(*server, *algo, *username, *password, *usetls > 0, *tlsfp, *proto)
+		}
+		report := checkConfig(o)
+		fmt.Println(report)
+		if !report.Ok {
+			os.Exit(EXIT_ERROR)
+		}
+		return
+	}
+
+	if *ty == "stats" {
+		if *state == "" {
+			fmt.Println("no -state file")
+			os.Exit(EXIT_ERROR)
+		}
+		st, err := LoadState(*state)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(EXIT_ERROR)
+		}
+		fmt.Print(st)
+		return
+	}
+
+	if confErr != nil {
+		loggo.Error("Error loading config: %v", confErr)
+		os.Exit(EXIT_ERROR)
+	}
+	if conf != nil && conf.DonateLevel != nil && *conf.DonateLevel > 0 {
+		loggo.Info("donate-level %v ignored, go-cpuminer has no donation", *conf.DonateLevel)
+	}
+
 	if *profile > 0 {
 		go http.ListenAndServe("0.0.0.0:"+strconv.Itoa(*profile), nil)
 	}
@@ -96,25 +188,126 @@ func main() {
 			return
 		}
 		r = t
-	} else if *ty == "miner" {
-		m, err := NewMiner(*server, *algo, *username, *password, *thread)
+	} else if *ty == "pool" {
+		p, err := NewStubPool(*listen, *algo, *jobs, *diff, time.Duration(*jobtime)*time.Second)
 		if err != nil {
-			loggo.Error("Error initializing miner: %v", err)
+			loggo.Error("Error initializing stub pool: %v", err)
 			return
 		}
-		r = m
+		r = p
+	} else if *ty == "miner" || *ty == "solo" || *ty == "proxy" {
+		var pools []*Pool
+		var err error
+		if conf != nil && len(conf.Pools) > 0 && !set["server"] {
+			pools, err = conf.pools(set, *username, *password, *algo, *proto, *tlsfp)
+		} else {
+			pools, err = NewPools(*server, *algo, *username, *password, *usetls > 0, *tlsfp, *proto)
+		}
+		if err != nil {
+			loggo.Error("Error initializing pools: %v", err)
+			os.Exit(EXIT_ERROR)
+		}
+		if *ty == "solo" {
+			for _, pool := range pools {
+				pool.daemon = true
+			}
+		}
+		proxyUrl, err := parseProxyUrl(*proxy)
+		if err != nil {
+			loggo.Error("Error initializing proxy: %v", err)
+			os.Exit(EXIT_ERROR)
+		}
+		reactions, err := parseReactions(*onerror)
+		if err != nil {
+			loggo.Error("Error initializing onerror: %v", err)
+			os.Exit(EXIT_ERROR)
+		}
+		cfg := StratumConfig{
+			retries:     *retries,
+			maxRetries:  *maxretries,
+			backoff:     time.Duration(*backoff) * time.Second,
+			backoffMax:  time.Duration(*backoffmax) * time.Second,
+			probe:       time.Duration(*probe) * time.Second,
+			proxy:       proxyUrl,
+			agent:       *agent,
+			background:  *waitpool > 0,
+			reactions:   reactions,
+			submitStale: *submitstale > 0,
+		}
+		reload := &ConfigReload{
+			set:      set,
+			user:     *username,
+			pass:     *password,
+			algo:     *algo,
+			proto:    *proto,
+			tlsfp:    *tlsfp,
+			loglevel: *loglevel,
+		}
+		if *ty == "proxy" {
+			if *api != "" {
+				// the api reports the workers and hashrate of a miner, the proxy has neither
+				loggo.Warn("Api %v is not served by -type proxy, ignored", *api)
+			}
+			p, err := NewProxy(pools, cfg, *listen)
+			if err != nil {
+				loggo.Error("Error initializing proxy: %v", err)
+				os.Exit(exitCode(err))
+			}
+			reload.setPools = p.setPools
+			r = p
+		} else {
+			cpus, err := parseAffinity(*affinity)
+			if err != nil {
+				loggo.Error("Error initializing affinity: %v", err)
+				os.Exit(EXIT_ERROR)
+			}
+			lifetime, err := NewLifetime(*state)
+			if err != nil {
+				loggo.Error("Error loading state: %v", err)
+				os.Exit(EXIT_ERROR)
+			}
+			m, err := NewMiner(pools, cfg, *thread, cpus, lifetime)
+			if err != nil {
+				loggo.Error("Error initializing miner: %v", err)
+				os.Exit(exitCode(err))
+			}
+			if *api != "" {
+				_, err := NewApi(*api, *apitoken, m)
+				if err != nil {
+					loggo.Error("Error initializing api: %v", err)
+					os.Exit(EXIT_ERROR)
+				}
+			}
+			reload.setPools = m.setPools
+			reload.setThreads = m.setThreads
+			reload.threads = m.threads
+			r = m
+		}
+		if conf != nil {
+			NewConfigWatcher(*config, reload)
+		}
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		defer common.CrashLog()
-		<-c
-		loggo.Warn("Got Control+C, exiting...")
+		sig := <-c
+		loggo.Warn("Got %v, exiting...", sig)
 		r.Stop()
+		<-c
+		loggo.Warn("Got %v again, exit now", sig)
+		os.Exit(EXIT_ERROR)
 	}()
 
 	r.Run()
 
+	if f, ok := r.(interface{ failure() error }); ok {
+		if err := f.failure(); err != nil {
+			loggo.Error("Exit on pool error: %v", err)
+			os.Exit(exitCode(err))
+		}
+	}
+
 	loggo.Info("exit...")
 }
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/esrrhs/gohome/loggo"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// loggo writes log files into the working dir unless told otherwise
+	loggo.Ini(loggo.Config{
+		Level:     loggo.LEVEL_ERROR,
+		Prefix:    "gocpuminer",
+		MaxDay:    1,
+		NoLogFile: true,
+		NoPrint:   true,
+	})
+	os.Exit(m.Run())
+}
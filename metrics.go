@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	kMetricsPrefix = "gocpuminer_"
+)
+
+type MetricsLabels struct {
+	pool string
+	algo string
+}
+
+// Metrics renders the prometheus text format, the counters are the Lifetime sessions, split by the pool and algo that were current when they grew
+type Metrics struct {
+	miner *Miner
+}
+
+func NewMetrics(m *Miner) *Metrics {
+	return &Metrics{
+		miner: m,
+	}
+}
+
+// serve reads the counters Run gives to the sessions every second, so they lag at most a second behind
+func (mt *Metrics) serve(w http.ResponseWriter, r *http.Request) {
+	m := mt.miner
+	l := m.labels()
+	keys, sessions := m.lifetime.sessions()
+	series := make([]StatSnapshot, len(sessions))
+	for i, s := range sessions {
+		series[i] = s.stat
+	}
+	latency := m.stat.snapshot().latency
+
+	var b bytes.Buffer
+
+	counter := func(name, help string, get func(c StatSnapshot) uint64) {
+		writeMetricsHeader(&b, name, "counter", help)
+		for i, k := range keys {
+			fmt.Fprintf(&b, "%s%s{%s} %d\n", kMetricsPrefix, name, k.String(), get(series[i]))
+		}
+	}
+	counter("hashes_total", "Hashes computed.", func(c StatSnapshot) uint64 { return c.hashes })
+	counter("jobs_total", "Jobs received from the pool.", func(c StatSnapshot) uint64 { return c.jobs })
+	counter("shares_submitted_total", "Shares submitted to the pool.", func(c StatSnapshot) uint64 { return c.submitted })
+	counter("shares_accepted_total", "Shares accepted by the pool.", func(c StatSnapshot) uint64 { return c.accepted })
+	counter("shares_rejected_total", "Shares rejected by the pool, stale ones not included.", func(c StatSnapshot) uint64 { return c.rejected() })
+	counter("shares_stale_total", "Shares found on a job that was gone, dropped or rejected by the pool.", func(c StatSnapshot) uint64 { return c.stale })
+	counter("shares_invalid_total", "Shares rejected for other reasons or never sent.", func(c StatSnapshot) uint64 { return c.invalid })
+	counter("reconnects_total", "Reconnects to the pool.", func(c StatSnapshot) uint64 { return c.reconnects })
+
+	writeMetricsHeader(&b, "pool_errors_total", "counter", "Errors the pool answered with, by kind.")
+	for i, k := range keys {
+		for kind, name := range kPoolErrorNames {
+			fmt.Fprintf(&b, "%spool_errors_total{%s,kind=\"%s\"} %d\n", kMetricsPrefix, k.String(), name, series[i].poolErrors[kind])
+		}
+	}
+
+	m.lock.Lock()
+	rates := make([][]*float64, len(m.workers))
+	for i := range m.workers {
+		rates[i] = m.hashrate.windows(i)
+	}
+	highest := m.hashrate.highest
+	m.lock.Unlock()
+
+	writeMetricsHeader(&b, "hashrate", "gauge", "Hashes per second of each worker thread, averaged over the window.")
+	for i, rate := range rates {
+		for j, v := range rate {
+			if v != nil {
+				fmt.Fprintf(&b, "%shashrate{%s,thread=\"%d\",window=\"%v\"} %v\n", kMetricsPrefix, l.String(), i, kHashrateWindowNames[j], *v)
+			}
+		}
+	}
+
+	writeMetricsHeader(&b, "hashrate_highest", "gauge", "Highest 10s total hashrate seen.")
+	fmt.Fprintf(&b, "%shashrate_highest{%s} %v\n", kMetricsPrefix, l.String(), highest)
+
+	writeMetricsHeader(&b, "pool_latency_seconds", "gauge", "Round trip of the last share submit.")
+	fmt.Fprintf(&b, "%spool_latency_seconds{%s} %v\n", kMetricsPrefix, l.String(),
+		latency.Seconds())
+
+	var diff float64
+	if j := m.currentJob(); j != nil {
+		diff = j.diff
+	}
+	writeMetricsHeader(&b, "share_difficulty", "gauge", "Difficulty of the current job.")
+	fmt.Fprintf(&b, "%sshare_difficulty{%s} %v\n", kMetricsPrefix, l.String(), diff)
+
+	connected := 0
+	if m.pool.state() == STRATUM_CONNECTED {
+		connected = 1
+	}
+	writeMetricsHeader(&b, "pool_connected", "gauge", "1 when the pool connection is up.")
+	fmt.Fprintf(&b, "%spool_connected{%s} %d\n", kMetricsPrefix, l.String(), connected)
+
+	writeMetricsHeader(&b, "uptime_seconds", "gauge", "Seconds since the miner started.")
+	fmt.Fprintf(&b, "%suptime_seconds %d\n", kMetricsPrefix, int64(time.Now().Sub(m.start)/time.Second))
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func (l MetricsLabels) String() string {
+	return "pool=" + quoteMetricsLabel(l.pool) + ",algo=" + quoteMetricsLabel(l.algo)
+}
+
+func writeMetricsHeader(b *bytes.Buffer, name, typ, help string) {
+	b.WriteString("# HELP " + kMetricsPrefix + name + " " + help + "\n")
+	b.WriteString("# TYPE " + kMetricsPrefix + name + " " + typ + "\n")
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteMetricsLabel(v string) string {
+	return `"` + metricsLabelEscaper.Replace(v) + `"`
+}
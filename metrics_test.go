@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, m *Miner) string {
+	w := httptest.NewRecorder()
+	NewMetrics(m).serve(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("content type %q", ct)
+	}
+	return w.Body.String()
+}
+
+// TestMetricsSeries checks the counters stay with the labels that were current when they grew, whenever the scrape comes
+func TestMetricsSeries(t *testing.T) {
+	m, _ := newTestMiner(t)
+	nextMinerJob(t, m)
+
+	l, err := NewLifetime("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.lifetime = l
+
+	a := MetricsLabels{pool: "a:1", algo: "cn/0"}
+	b := MetricsLabels{pool: "b:2", algo: "cn/r"}
+	now := time.Now()
+	first := StatSnapshot{hashes: 100, jobs: 2, submitted: 3, accepted: 2, invalid: 1}
+	l.updateAt(a, first, now.Add(time.Second))
+	second := first
+	second.hashes = 150
+	second.accepted = 3
+	second.stale = 1
+	second.reconnects = 1
+	second.poolErrors[POOL_ERROR_DUPLICATE] = 1
+	l.updateAt(b, second, now.Add(time.Second*2))
+
+	out := scrapeMetrics(t, m)
+	for _, want := range []string{
+		`# TYPE gocpuminer_hashes_total counter`,
+		`gocpuminer_hashes_total{pool="a:1",algo="cn/0"} 100`,
+		`gocpuminer_hashes_total{pool="b:2",algo="cn/r"} 50`,
+		`gocpuminer_jobs_total{pool="a:1",algo="cn/0"} 2`,
+		`gocpuminer_jobs_total{pool="b:2",algo="cn/r"} 0`,
+		`gocpuminer_shares_accepted_total{pool="a:1",algo="cn/0"} 2`,
+		`gocpuminer_shares_accepted_total{pool="b:2",algo="cn/r"} 1`,
+		`gocpuminer_shares_rejected_total{pool="a:1",algo="cn/0"} 1`,
+		`gocpuminer_shares_stale_total{pool="b:2",algo="cn/r"} 1`,
+		`gocpuminer_reconnects_total{pool="b:2",algo="cn/r"} 1`,
+		`gocpuminer_pool_errors_total{pool="b:2",algo="cn/r",kind="duplicate"} 1`,
+		`gocpuminer_pool_errors_total{pool="a:1",algo="cn/0",kind="duplicate"} 0`,
+		`# TYPE gocpuminer_share_difficulty gauge`,
+		`gocpuminer_pool_connected{`,
+		`gocpuminer_uptime_seconds `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %q in\n%v", want, out)
+		}
+	}
+
+	// a scrape with nothing new changes no counter
+	if again := scrapeMetrics(t, m); counterLines(again) != counterLines(out) {
+		t.Errorf("counters moved between scrapes\n%v\n%v", counterLines(out), counterLines(again))
+	}
+}
+
+func TestMetricsLabelQuote(t *testing.T) {
+	l := MetricsLabels{pool: `a"b\c` + "\n", algo: "cn/0"}
+	if got, want := l.String(), `pool="a\"b\\c\n",algo="cn/0"`; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func counterLines(out string) string {
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, kMetricsPrefix) && strings.Contains(line, "_total{") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,67 +1,102 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"github.com/esrrhs/gohome/common"
-	"github.com/esrrhs/gohome/crypto"
 	"github.com/esrrhs/gohome/loggo"
 	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	kMinerStopTimeout = time.Second * 10
+)
+
+// Client is where the miner gets jobs from and submits results to
+type Client interface {
+	submit(result *JobResult)
+	hb()
+	current() *Pool
+	state() int32
+	stateName() string
+	usePool(index int) error
+	poolList() []*Pool
+	setPools(pools []*Pool) error
+	lastError() error
+	stop(deadline time.Time) // waits for the answers to the submits in flight until deadline, then closes for good
+}
+
 type Miner struct {
-	validShares   uint64
-	staleShares   uint64
-	invalidShares uint64
+	ctx         context.Context
+	cancel      context.CancelFunc
+	start       time.Time
+	poolStopped bool // Run gave up because the pool client stopped, not because of Stop
 
-	exit bool
+	wg      sync.WaitGroup // running workers
+	flushed chan struct{}  // closed when commit submitted what the stopped workers found
 
-	pool    *Stratum
+	pool    Client
 	workers []*Worker
 	jobs    chan *Job
 	result  chan *JobResult
 
-	stat *Stat
+	stat     *Stat
+	lifetime *Lifetime // counters split by pool and algo, updated by Run
+	affinity []int     // cpus the workers are pinned to in turn, empty no pinning
+
+	lock        sync.Mutex
+	job         *Job
+	prev        *Job // the job before, its shares are stale
+	submitStale bool
+	solo        bool
+	seq         uint64
+	non         *Nonce
+	last        *Job // the last job mined, kept over a disconnect so a redelivered job goes on with its nonces
+	filter      *NonceFilter
+	paused      bool
+	hashrate    *Hashrate
 }
 
-func NewMiner(server string, algo string, usrname string, password string, thread int) (*Miner, error) {
+func NewMiner(pools []*Pool, cfg StratumConfig, thread int, affinity []int, lifetime *Lifetime) (*Miner, error) {
 	m := &Miner{}
+	m.lifetime = lifetime
+	m.affinity = affinity
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.flushed = make(chan struct{})
+	m.start = time.Now()
+	m.hashrate = NewHashrate()
+	m.submitStale = cfg.submitStale
+	m.filter = NewNonceFilter()
 
-	var al *Algorithm
-	if algo != "" {
-		al = NewAlgorithm(algo)
-		if al.id == INVALID {
-			return nil, errors.New("Unable to create algo " + algo)
-		}
-		if al.supportAlgoName() == "" {
-			return nil, errors.New("Unable to support algo " + algo)
-		}
-		if !crypto.TestSum(al.supportAlgoName()) {
-			return nil, errors.New("test algo fail " + algo)
-		}
+	err := checkMinerPools(pools)
+	if err != nil {
+		return nil, err
 	}
 
 	m.jobs = make(chan *Job, 16)
 	m.result = make(chan *JobResult, 1024)
 	m.stat = &Stat{}
 
-	p, err := NewStratum(server, al, usrname, password, m.jobs, m.stat)
-	if err != nil {
-		return nil, err
+	m.solo = pools[0].daemon
+	if m.solo {
+		d, err := NewDaemon(pools, cfg, m.jobs, m.stat)
+		if err != nil {
+			return nil, err
+		}
+		m.pool = d
+	} else {
+		p, err := NewStratum(pools, cfg, m.jobs, m.stat)
+		if err != nil {
+			return nil, err
+		}
+		m.pool = p
 	}
-	m.pool = p
 
-	if thread <= 0 {
-		thread = 1
-	}
-	m.workers = make([]*Worker, thread)
-	for i, _ := range m.workers {
-		w := NewWorker(m.result, m.stat)
-		m.workers[i] = w
-		go func() {
-			defer common.CrashLog()
-			w.start()
-		}()
-	}
+	m.setThreads(thread)
 
 	go func() {
 		defer common.CrashLog()
@@ -76,44 +111,355 @@ func NewMiner(server string, algo string, usrname string, password string, threa
 	return m, nil
 }
 
+// checkMinerPools makes sure every pool algo can be mined and solo and pool mining are not mixed
+func checkMinerPools(pools []*Pool) error {
+	if len(pools) == 0 {
+		return errors.New("no pool")
+	}
+	err := checkPoolMix(pools, pools[0].daemon)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if pool.algo != nil {
+			err := checkAlgo(pool.algo)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Miner) addWorker() {
+	cpu := -1
+	if len(m.affinity) > 0 {
+		cpu = m.affinity[len(m.workers)%len(m.affinity)]
+	}
+	w := NewWorker(m.ctx, m.result, m.stat, cpu)
+	m.workers = append(m.workers, w)
+	if m.job != nil && !m.paused {
+		w.setJob(m.job, m.seq, m.non)
+	}
+	m.wg.Add(1)
+	go func() {
+		defer common.CrashLog()
+		defer m.wg.Done()
+		w.start()
+	}()
+}
+
+// setThreads starts or stops workers, a new worker joins the current job and shares its nonce space
+func (m *Miner) setThreads(thread int) {
+	if thread <= 0 {
+		thread = 1
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.ctx.Err() != nil {
+		return
+	}
+
+	for len(m.workers) < thread {
+		m.addWorker()
+	}
+	for len(m.workers) > thread {
+		n := len(m.workers) - 1
+		w := m.workers[n]
+		w.stop()
+		m.workers = m.workers[:n]
+	}
+	m.hashrate.resize(len(m.workers))
+
+	loggo.Info("Miner threads %v", len(m.workers))
+}
+
+func (m *Miner) threads() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.workers)
+}
+
+func (m *Miner) pause() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.paused {
+		return
+	}
+	m.paused = true
+	addNonceSequence()
+	for _, w := range m.workers {
+		w.clearJob()
+	}
+	loggo.Warn("Miner paused")
+}
+
+// resume restarts the workers on the latest job, which keeps arriving while paused,
+// dispatch gave a new job fresh nonces already, the same job goes on where the workers stopped
+func (m *Miner) resume() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.paused {
+		return
+	}
+	m.paused = false
+	if m.job != nil {
+		m.seq = addNonceSequence()
+		for _, w := range m.workers {
+			w.setJob(m.job, m.seq, m.non)
+		}
+	}
+	loggo.Warn("Miner resumed")
+}
+
+func (m *Miner) isPaused() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.paused
+}
+
+func (m *Miner) usePool(index int) error {
+	return m.pool.usePool(index)
+}
+
+// setPools hands a reloaded pool list to the pool client, the workers keep mining until its job changes
+func (m *Miner) setPools(pools []*Pool) error {
+	err := checkMinerPools(pools)
+	if err != nil {
+		return err
+	}
+	if pools[0].daemon != m.pool.current().daemon {
+		return errors.New("can not switch between solo and pool mining without restart")
+	}
+	return m.pool.setPools(pools)
+}
+
 func (m *Miner) Stop() {
-	m.exit = true
+	m.cancel()
+}
+
+// failure is why Run gave up on the pool, nil when it was stopped
+func (m *Miner) failure() error {
+	if !m.poolStopped {
+		return nil
+	}
+	if err := m.pool.lastError(); err != nil {
+		return err
+	}
+	return errors.New("pool stopped")
 }
 
 func (m *Miner) Run() {
 	start := time.Now()
-	for !m.exit {
+	for m.ctx.Err() == nil {
+		if m.pool.state() == STRATUM_STOPPED {
+			loggo.Error("Miner pool stopped, exiting")
+			m.poolStopped = true
+			break
+		}
+		m.sample()
 		if time.Now().Sub(start) > time.Minute {
-			elapse := time.Now().Sub(start)
 			start = time.Now()
-			speed := float32(m.stat.hash) / float32(elapse/time.Second)
-			loggo.Info("HashSpeed=%v/s, Job=%v, JobSubmit=%v, JobAccept=%v, JobFail=%v", speed, m.stat.job,
-				m.stat.submitJob, m.stat.submitJobOK, m.stat.submitJobFail)
-			m.stat.clear()
+			m.lock.Lock()
+			rates := m.hashrate.windows(-1)
+			highest := m.hashrate.highest
+			m.lock.Unlock()
+			snap := m.stat.snapshot()
+			loggo.Info("HashSpeed=%v/%v/%v H/s (10s/60s/15m), Highest=%.2f, Job=%v, JobSubmit=%v, JobAccept=%v, JobStale=%v, JobInvalid=%v, Pool=%v, State=%v, Threads=%v, Paused=%v",
+				formatRate(rates[0]), formatRate(rates[1]), formatRate(rates[2]), highest, snap.jobs,
+				snap.submitted, snap.accepted, snap.stale, snap.invalid, m.pool.current(), m.pool.stateName(), m.threads(), m.isPaused())
 		}
 		m.pool.hb()
-		time.Sleep(time.Second)
+		m.lifetime.update(m.labels(), m.stat.snapshot())
+		if err := m.lifetime.save(false); err != nil {
+			loggo.Error("Miner save state fail %v", err)
+		}
+		select {
+		case <-m.ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
+
+	m.shutdown()
+}
+
+// shutdown stops the workers, submits the shares they found and waits for the pool to answer before closing it
+func (m *Miner) shutdown() {
+	loggo.Warn("Miner stopping...")
+	deadline := time.Now().Add(kMinerStopTimeout)
+	m.cancel()
+
+	select {
+	case <-m.flushed:
+	case <-time.After(deadline.Sub(time.Now())):
+		loggo.Warn("Miner stop timeout, shares still queued are lost")
+	}
+	m.pool.stop(deadline)
+
+	m.lifetime.update(m.labels(), m.stat.snapshot())
+	if err := m.lifetime.save(true); err != nil {
+		loggo.Error("Miner save state fail %v", err)
+	}
+	m.printSummary()
+}
+
+// printSummary logs the totals of the whole session
+func (m *Miner) printSummary() {
+	uptime := time.Now().Sub(m.start)
+	snap := m.stat.snapshot()
+	m.lock.Lock()
+	highest := m.hashrate.highest
+	m.lock.Unlock()
+
+	var errs []string
+	for kind, name := range kPoolErrorNames {
+		if snap.poolErrors[kind] > 0 {
+			errs = append(errs, fmt.Sprintf("%v=%v", name, snap.poolErrors[kind]))
+		}
+	}
+
+	loggo.Info("Miner session Uptime=%v, Hashes=%v, HashSpeed=%.2f H/s, Highest=%.2f, Job=%v, JobSubmit=%v, JobAccept=%v, JobStale=%v, JobInvalid=%v, Reconnects=%v, PoolErrors=[%v]",
+		uptime.Truncate(time.Second), snap.hashes, float64(snap.hashes)/uptime.Seconds(), highest, snap.jobs,
+		snap.submitted, snap.accepted, snap.stale, snap.invalid, snap.reconnects, strings.Join(errs, " "))
+
+	keys, sessions := m.lifetime.sessions()
+	for i, k := range keys {
+		s := sessions[i]
+		loggo.Info("Miner session Pool=%v, Algo=%v, Uptime=%v, Hashes=%v, JobSubmit=%v, JobAccept=%v, JobStale=%v, JobInvalid=%v",
+			k.pool, k.algo, s.uptime.Truncate(time.Second), s.stat.hashes, s.stat.submitted, s.stat.accepted, s.stat.stale, s.stat.invalid)
+	}
+	if m.lifetime.file != "" {
+		st := m.lifetime.state()
+		loggo.Info("Miner lifetime Sessions=%v, Uptime=%v, saved to %v", st.Sessions, time.Duration(st.Uptime)*time.Second, m.lifetime.file)
+	}
+}
+
+// labels are the pool and algo the counters are given to right now
+func (m *Miner) labels() MetricsLabels {
+	pool := m.pool.current()
+	l := MetricsLabels{pool: pool.url}
+	if j := m.currentJob(); j != nil {
+		l.algo = j.algorithm.name()
+	} else if pool.algo != nil {
+		l.algo = pool.algo.name()
+	}
+	return l
+}
+
+// sample records every worker's hash counter, the rolling hashrate windows are computed from these
+func (m *Miner) sample() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	for i, w := range m.workers {
+		m.hashrate.add(i, now, atomic.LoadUint64(&w.hashes))
+	}
+	m.hashrate.updateHighest()
+}
+
+func (m *Miner) currentJob() *Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.job
+}
+
+// fresh tells whether a share found on job can still be submitted, results queued while a new job came in are stale.
+// Jobs are compared by work, a job the pool redelivers after a reconnect is a new Job of the same work
+func (m *Miner) fresh(job *Job) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// the daemon keeps the last templates and knows which ones still build on the chain tip
+	if m.solo || sameWork(job, m.job) {
+		return true
+	}
+	return m.submitStale && sameWork(job, m.prev)
+}
+
+func sameWork(a *Job, b *Job) bool {
+	return a != nil && b != nil && a.work() == b.work()
 }
 
 func (m *Miner) commit() {
+	defer close(m.flushed)
+
+	// stopped workers finish the hash at hand, what they found is still worth submitting
+	stopped := make(chan struct{})
+	go func() {
+		defer common.CrashLog()
+		<-m.ctx.Done()
+		m.wg.Wait()
+		close(stopped)
+	}()
+
 	for {
 		select {
 		case data := <-m.result:
-			m.pool.submit(data)
+			m.commitResult(data)
+		case <-stopped:
+			for {
+				select {
+				case data := <-m.result:
+					m.commitResult(data)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
+func (m *Miner) commitResult(data *JobResult) {
+	if !m.fresh(data.job) {
+		loggo.Warn("Miner drop stale share job=%v nonce=%v", data.job.id, data.nonce)
+		m.stat.addStale()
+		return
+	}
+	if !m.filter.add(data.job, data.nonce) {
+		loggo.Warn("Miner drop duplicate share job=%v nonce=%v", data.job.id, data.nonce)
+		return
+	}
+	m.pool.submit(data)
+}
+
 func (m *Miner) dispatch() {
 	for {
 		select {
+		case <-m.ctx.Done():
+			return
 		case j := <-m.jobs:
-			seq := addNonceSequence()
-			non := &Nonce{}
-			for _, w := range m.workers {
-				w.setJob(j, seq, non)
+			m.lock.Lock()
+			if j != nil && m.job != nil {
+				m.prev = m.job
+			} else {
+				// a new connection doesn't know the jobs of the old one
+				m.prev = nil
+			}
+			m.job = j
+			m.seq = addNonceSequence()
+			if j != nil {
+				if sameWork(j, m.last) {
+					loggo.Info("Miner job %v redelivered, go on with its nonces", j.id)
+				} else {
+					m.non = &Nonce{}
+				}
+				m.last = j
+			}
+			if j == nil {
+				for _, w := range m.workers {
+					w.clearJob()
+				}
+				m.lock.Unlock()
+				loggo.Warn("Miner pause workers, pool disconnected")
+				continue
+			}
+			if !m.paused {
+				for _, w := range m.workers {
+					w.setJob(j, m.seq, m.non)
+				}
 			}
+			m.lock.Unlock()
 			loggo.Info("Miner setJob ok id=%v algo=%v height=%v target=%v diff=%v", j.id, j.algorithm.name(), j.height, j.target, j.diff)
 		}
 	}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestDispatch is a miner without pool and workers, jobs are fed to dispatch by hand
+func newTestDispatch(t *testing.T) *Miner {
+	m := &Miner{
+		jobs:   make(chan *Job),
+		filter: NewNonceFilter(),
+		stat:   &Stat{},
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	t.Cleanup(m.cancel)
+	go m.dispatch()
+	return m
+}
+
+// deliver hands the job to dispatch and waits until it is in use
+func deliver(t *testing.T, m *Miner, j *Job) {
+	m.jobs <- j
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if m.currentJob() == j {
+			return
+		}
+	}
+	t.Fatal("job not dispatched")
+}
+
+func testJob(id string) *Job {
+	return &Job{id: id, algorithm: NewAlgorithm("cn/0")}
+}
+
+func TestDispatchRedelivery(t *testing.T) {
+	m := newTestDispatch(t)
+
+	deliver(t, m, testJob("a"))
+
+	tests := []struct {
+		name string
+		job  *Job
+		goOn bool
+	}{
+		// the pool resends the job after a reconnect
+		{"redelivered", testJob("a"), true},
+		{"redelivered again", testJob("a"), true},
+		{"new job", testJob("b"), false},
+		{"new extranonce2", &Job{id: "b", extraNonce2: "01", algorithm: NewAlgorithm("cn/0")}, false},
+	}
+	for _, tt := range tests {
+		before := m.non
+		before.nonces += 10
+		deliver(t, m, nil)
+		deliver(t, m, tt.job)
+		m.lock.Lock()
+		non := m.non
+		m.lock.Unlock()
+		if got := non == before; got != tt.goOn {
+			t.Errorf("%v: continued %v, want %v", tt.name, got, tt.goOn)
+		}
+		if tt.goOn && non.nonces != before.nonces {
+			t.Errorf("%v: nonce %v, want %v", tt.name, non.nonces, before.nonces)
+		}
+		if !tt.goOn && non.nonces != 0 {
+			t.Errorf("%v: nonce %v, want 0", tt.name, non.nonces)
+		}
+	}
+}
+
+// testClient takes the submits, the miner calls nothing else on the way to the pool
+type testClient struct {
+	Client
+	submitted []*JobResult
+}
+
+func (c *testClient) submit(result *JobResult) {
+	c.submitted = append(c.submitted, result)
+}
+
+func TestCommitStale(t *testing.T) {
+	tests := []struct {
+		name        string
+		submitStale bool
+		job         string // the job the share was found on, a fresh Job of that work
+		submitted   bool
+	}{
+		{"current", false, "b", true},
+		{"previous", false, "a", false},
+		{"previous with -submitstale", true, "a", true},
+		{"older", true, "old", false},
+	}
+	for _, tt := range tests {
+		m := newTestDispatch(t)
+		c := &testClient{}
+		m.pool = c
+		m.submitStale = tt.submitStale
+		deliver(t, m, testJob("old"))
+		deliver(t, m, testJob("a"))
+		deliver(t, m, testJob("b"))
+
+		// a redelivered job is another Job of the same work, its shares are no less fresh
+		m.commitResult(&JobResult{job: testJob(tt.job), nonce: 1})
+		if got := len(c.submitted) == 1; got != tt.submitted {
+			t.Errorf("%v: submitted %v, want %v", tt.name, got, tt.submitted)
+		}
+		stale := uint64(1)
+		if tt.submitted {
+			stale = 0
+		}
+		if snap := m.stat.snapshot(); snap.stale != stale {
+			t.Errorf("%v: stale %v, want %v", tt.name, snap.stale, stale)
+		}
+	}
+}
+
+func TestCommitRedelivered(t *testing.T) {
+	m := newTestDispatch(t)
+	c := &testClient{}
+	m.pool = c
+	before := testJob("a")
+	deliver(t, m, before)
+	deliver(t, m, nil)
+	deliver(t, m, testJob("a"))
+
+	// found before the reconnect, submitted after the pool sent the same job again
+	m.commitResult(&JobResult{job: before, nonce: 1})
+	m.commitResult(&JobResult{job: before, nonce: 1})
+	if len(c.submitted) != 1 || m.stat.snapshot().stale != 0 {
+		t.Errorf("submitted %v stale %v, want 1 0", len(c.submitted), m.stat.snapshot().stale)
+	}
+}
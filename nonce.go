@@ -2,10 +2,44 @@ package main
 
 import "sync/atomic"
 
+const (
+	kNonceFilterJobs = 4
+)
+
 type Nonce struct {
 	nonces uint64
 }
 
+// NonceFilter remembers the nonces submitted for the last jobs, so a share is never sent twice
+type NonceFilter struct {
+	works []string
+	seen  map[string]map[uint32]bool
+}
+
+func NewNonceFilter() *NonceFilter {
+	return &NonceFilter{seen: make(map[string]map[uint32]bool)}
+}
+
+// add returns false when the nonce of the job was already submitted
+func (f *NonceFilter) add(job *Job, nonce uint32) bool {
+	work := job.work()
+	seen, ok := f.seen[work]
+	if !ok {
+		seen = make(map[uint32]bool)
+		f.seen[work] = seen
+		f.works = append(f.works, work)
+		if len(f.works) > kNonceFilterJobs {
+			delete(f.seen, f.works[0])
+			f.works = f.works[1:]
+		}
+	}
+	if seen[nonce] {
+		return false
+	}
+	seen[nonce] = true
+	return true
+}
+
 var gSequence uint64
 
 func addNonceSequence() uint64 {
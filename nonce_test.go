@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNonceFilterDuplicate(t *testing.T) {
+	f := NewNonceFilter()
+	j := &Job{id: "a"}
+	if !f.add(j, 1) || !f.add(j, 2) {
+		t.Fatal("first nonces dropped")
+	}
+	if f.add(j, 1) {
+		t.Error("duplicate nonce passed")
+	}
+	// a redelivered job is the same work, its nonces are still known
+	if f.add(&Job{id: "a"}, 2) {
+		t.Error("duplicate nonce of a redelivered job passed")
+	}
+	// the same nonce on other work is a different share
+	if !f.add(&Job{id: "b"}, 1) || !f.add(&Job{id: "a", extraNonce2: "01"}, 1) {
+		t.Error("nonce of other work dropped")
+	}
+}
+
+func TestNonceFilterEvict(t *testing.T) {
+	f := NewNonceFilter()
+	jobs := make([]*Job, kNonceFilterJobs+1)
+	for i := range jobs {
+		jobs[i] = &Job{id: fmt.Sprint(i)}
+		f.add(jobs[i], 7)
+	}
+	if len(f.works) != kNonceFilterJobs || len(f.seen) != kNonceFilterJobs {
+		t.Fatalf("keeps %v/%v works, want %v", len(f.works), len(f.seen), kNonceFilterJobs)
+	}
+	// the oldest work was forgotten, the newer ones are still filtered
+	for i := len(jobs) - 1; i >= 1; i-- {
+		if f.add(jobs[i], 7) {
+			t.Errorf("job %v forgotten", i)
+		}
+	}
+	if !f.add(jobs[0], 7) {
+		t.Error("oldest job still filtered")
+	}
+}
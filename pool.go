@@ -0,0 +1,181 @@
+package main
+
+import (
+	"github.com/esrrhs/gohome/crypto"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+type Pool struct {
+	url    string
+	host   string
+	tls    bool
+	tlsfp  string
+	user   string
+	pass   string
+	algo   *Algorithm
+	proto  string
+	daemon bool   // solo mining against a monerod compatible json rpc
+	rigid  string // rig-id sent at login, pools show it as the worker name
+}
+
+func NewPool(url string, algo string, user string, pass string, tls bool, tlsfp string, proto string) (*Pool, error) {
+	host, urltls, daemon, err := parsePoolUrl(url)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkProtocol(proto)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pool{
+		url:    url,
+		host:   host,
+		tls:    tls || urltls,
+		tlsfp:  tlsfp,
+		user:   user,
+		pass:   pass,
+		proto:  proto,
+		daemon: daemon,
+	}
+
+	if algo != "" {
+		al := NewAlgorithm(algo)
+		if al.id == INVALID {
+			return nil, errors.New("Unable to create algo " + algo)
+		}
+		p.algo = al
+	}
+
+	return p, nil
+}
+
+// NewPools builds the failover list from comma separated flags
+func NewPools(servers string, algos string, users string, passes string, tls bool, tlsfps string, protos string) ([]*Pool, error) {
+	specs := flagPools(servers, algos, users, passes, tls, tlsfps, protos)
+	if len(specs) == 0 {
+		return nil, errors.New("no pool server")
+	}
+
+	var pools []*Pool
+	for _, spec := range specs {
+		p, err := spec.newPool()
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, p)
+	}
+	return pools, nil
+}
+
+// flagPools splits the comma separated flags into one entry per pool, missing user/pass/algo/tlsfp/proto entries reuse the last one
+func flagPools(servers string, algos string, users string, passes string, tls bool, tlsfps string, protos string) []ConfigPool {
+	urls := splitList(servers)
+	al := splitList(algos)
+	us := splitList(users)
+	ps := splitList(passes)
+	fs := splitList(tlsfps)
+	pr := splitList(protos)
+
+	var specs []ConfigPool
+	for i, url := range urls {
+		specs = append(specs, ConfigPool{
+			Url:            url,
+			User:           listAt(us, i),
+			Pass:           listAt(ps, i),
+			Algo:           listAt(al, i),
+			Tls:            tls,
+			TlsFingerprint: listAt(fs, i),
+			Protocol:       listAt(pr, i),
+		})
+	}
+	return specs
+}
+
+func (p *Pool) String() string {
+	return p.url
+}
+
+// same tells whether a reloaded pool is the one already in use, so its connection can be kept
+func (p *Pool) same(o *Pool) bool {
+	algo := func(p *Pool) string {
+		if p.algo == nil {
+			return ""
+		}
+		return p.algo.name()
+	}
+	return p.url == o.url && p.user == o.user && p.pass == o.pass && p.tls == o.tls && p.tlsfp == o.tlsfp &&
+		p.proto == o.proto && p.daemon == o.daemon && p.rigid == o.rigid && algo(p) == algo(o)
+}
+
+// checkPoolList makes sure a failover list is not empty and all its pools are daemons, or none is
+func checkPoolList(pools []*Pool, daemon bool) error {
+	if len(pools) == 0 {
+		return errors.New("no pool")
+	}
+	err := checkPoolMix(pools, daemon)
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if pool.daemon && pool.algo == nil {
+			return errors.New("daemon pool needs algo " + pool.url)
+		}
+	}
+	return nil
+}
+
+// checkPoolMix makes sure solo and pool mining are not mixed, one client can't speak both
+func checkPoolMix(pools []*Pool, daemon bool) error {
+	for _, pool := range pools {
+		if pool.daemon != daemon {
+			return errors.New("daemon and stratum pools can not be mixed " + pool.url)
+		}
+	}
+	return nil
+}
+
+// reselect finds the pool in use in a reloaded list, a new primary is used right away,
+// a failover pool is kept until the probe moves back to the primary, -1 means use the new primary
+func reselect(pools []*Pool, old *Pool, cur int) int {
+	for i, pool := range pools {
+		if pool.same(old) && (i == 0 || cur != 0) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkAlgo makes sure the hash backend can mine the algo
+func checkAlgo(al *Algorithm) error {
+	if al.supportAlgoName() == "" {
+		return errors.New("Unable to support algo " + al.name())
+	}
+	if !crypto.TestSum(al.supportAlgoName()) {
+		return errors.New("test algo fail " + al.name())
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var ret []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+func listAt(list []string, i int) string {
+	if len(list) == 0 {
+		return ""
+	}
+	if i >= len(list) {
+		return list[len(list)-1]
+	}
+	return list[i]
+}
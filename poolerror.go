@@ -0,0 +1,191 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+	"strings"
+)
+
+// exit codes of the miner, so supervisors can tell a bad wallet from a pool that is down
+const (
+	EXIT_OK       = 0
+	EXIT_ERROR    = 1 // bad flags or config, anything not below
+	EXIT_DIAL     = 2
+	EXIT_LOGIN    = 3
+	EXIT_PROTOCOL = 4
+	EXIT_BANNED   = 5
+)
+
+// kinds of errors a pool sends back, told apart by the message since pools don't agree on codes
+const (
+	POOL_ERROR_LOGIN           = iota // login refused, bad wallet or password
+	POOL_ERROR_BANNED                 // ip or wallet banned
+	POOL_ERROR_UNAUTHENTICATED        // the pool lost our session
+	POOL_ERROR_JOB_NOT_FOUND          // share for a job the pool already dropped
+	POOL_ERROR_LOW_DIFFICULTY
+	POOL_ERROR_DUPLICATE
+	POOL_ERROR_OTHER
+	POOL_ERROR_COUNT
+)
+
+var kPoolErrorNames = [POOL_ERROR_COUNT]string{"login", "banned", "unauthenticated", "job-not-found", "low-difficulty", "duplicate", "other"}
+
+// what the pool client does after a pool error
+const (
+	REACT_IGNORE  = iota // only count it
+	REACT_RELOGIN        // reconnect to the same pool and login again
+	REACT_SWITCH         // failover to the next pool
+	REACT_STOP           // stop the miner, main exits with the error code
+)
+
+var kReactNames = []string{"ignore", "relogin", "switch", "stop"}
+
+var kDefaultReactions = [POOL_ERROR_COUNT]int{
+	POOL_ERROR_LOGIN:           REACT_SWITCH,
+	POOL_ERROR_BANNED:          REACT_SWITCH,
+	POOL_ERROR_UNAUTHENTICATED: REACT_RELOGIN,
+}
+
+var kPoolErrorWords = []struct {
+	kind  int
+	words []string
+}{
+	{POOL_ERROR_BANNED, []string{"banned"}},
+	{POOL_ERROR_UNAUTHENTICATED, []string{"unauthenticated", "unauthorized", "not authorized", "not logged in"}},
+	{POOL_ERROR_JOB_NOT_FOUND, []string{"expired", "stale", "job not found", "invalid job"}},
+	{POOL_ERROR_LOW_DIFFICULTY, []string{"low difficulty", "low diff"}},
+	{POOL_ERROR_DUPLICATE, []string{"duplicate"}},
+	{POOL_ERROR_LOGIN, []string{"invalid address", "invalid wallet", "invalid payment address", "invalid login", "bad login"}},
+}
+
+// classifyPoolError tells the kind of a pool error message, matching is by keyword so it works across pool software
+func classifyPoolError(msg string) int {
+	msg = strings.ToLower(msg)
+	for _, w := range kPoolErrorWords {
+		for _, word := range w.words {
+			if strings.Contains(msg, word) {
+				return w.kind
+			}
+		}
+	}
+	return POOL_ERROR_OTHER
+}
+
+// parseReactions reads kind=reaction pairs like "banned=stop,unauthenticated=relogin" over the defaults
+func parseReactions(s string) ([POOL_ERROR_COUNT]int, error) {
+	reactions := kDefaultReactions
+	for _, item := range splitList(s) {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return reactions, errors.New("bad reaction " + item + ", want kind=reaction")
+		}
+		kind := indexOf(kPoolErrorNames[:], strings.TrimSpace(kv[0]))
+		if kind < 0 {
+			return reactions, errors.New("unknown pool error kind " + kv[0] + ", one of " + strings.Join(kPoolErrorNames[:], "/"))
+		}
+		react := indexOf(kReactNames, strings.TrimSpace(kv[1]))
+		if react < 0 {
+			return reactions, errors.New("unknown reaction " + kv[1] + ", one of " + strings.Join(kReactNames, "/"))
+		}
+		reactions[kind] = react
+	}
+	return reactions, nil
+}
+
+// formatReactions is the inverse of parseReactions, sorted so a config map always gives the same flag
+func formatReactions(m map[string]string) string {
+	var items []string
+	for k, v := range m {
+		items = append(items, k+"="+v)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// PoolError is a pool error whose reaction was to stop
+type PoolError struct {
+	Pool    string
+	Kind    int
+	Message string
+}
+
+func (e *PoolError) Error() string {
+	return kPoolErrorNames[e.Kind] + " error from " + e.Pool + ": " + e.Message
+}
+
+// DialError is a pool that can not be reached, the connect through the proxy, the tls handshake or the first write failed
+type DialError struct {
+	Pool string
+	Err  error
+}
+
+func (e *DialError) Error() string {
+	return "dial " + e.Pool + " fail: " + e.Err.Error()
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// LoginError is a pool that refused the login, trying the same wallet again won't help
+type LoginError struct {
+	Pool    string
+	Message string
+}
+
+func (e *LoginError) Error() string {
+	return "login " + e.Pool + " rejected: " + e.Message
+}
+
+// ProtocolError is a pool that answered the login with something we can not understand, or did not answer at all
+type ProtocolError struct {
+	Pool string
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol " + e.Pool + " fail: " + e.Err.Error()
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	var dial *DialError
+	var login *LoginError
+	var proto *ProtocolError
+	var pool *PoolError
+	switch {
+	case errors.As(err, &pool):
+		switch pool.Kind {
+		case POOL_ERROR_BANNED:
+			return EXIT_BANNED
+		case POOL_ERROR_LOGIN, POOL_ERROR_UNAUTHENTICATED:
+			return EXIT_LOGIN
+		}
+		return EXIT_PROTOCOL
+	case errors.As(err, &login):
+		if classifyPoolError(login.Message) == POOL_ERROR_BANNED {
+			return EXIT_BANNED
+		}
+		return EXIT_LOGIN
+	case errors.As(err, &proto):
+		return EXIT_PROTOCOL
+	case errors.As(err, &dial):
+		return EXIT_DIAL
+	}
+	return EXIT_ERROR
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestClassifyPoolError(t *testing.T) {
+	tests := []struct {
+		msg  string
+		kind int
+	}{
+		{"Invalid address used for login", POOL_ERROR_LOGIN},
+		{"invalid payment address provided", POOL_ERROR_LOGIN},
+		{"IP Address currently banned", POOL_ERROR_BANNED},
+		{"Unauthenticated", POOL_ERROR_UNAUTHENTICATED},
+		{"not logged in", POOL_ERROR_UNAUTHENTICATED},
+		{"Block expired", POOL_ERROR_JOB_NOT_FOUND},
+		{"Invalid job id", POOL_ERROR_JOB_NOT_FOUND},
+		{"Low difficulty share", POOL_ERROR_LOW_DIFFICULTY},
+		{"Duplicate share", POOL_ERROR_DUPLICATE},
+		{"Invalid result", POOL_ERROR_OTHER},
+		{"", POOL_ERROR_OTHER},
+	}
+	for _, tt := range tests {
+		if got := classifyPoolError(tt.msg); got != tt.kind {
+			t.Errorf("classifyPoolError(%q) = %v, want %v", tt.msg, kPoolErrorNames[got], kPoolErrorNames[tt.kind])
+		}
+	}
+}
+
+func TestParseReactions(t *testing.T) {
+	r, err := parseReactions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != kDefaultReactions {
+		t.Errorf("empty gives %v, want the defaults %v", r, kDefaultReactions)
+	}
+
+	r, err = parseReactions(" banned = stop, duplicate=relogin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := kDefaultReactions
+	want[POOL_ERROR_BANNED] = REACT_STOP
+	want[POOL_ERROR_DUPLICATE] = REACT_RELOGIN
+	if r != want {
+		t.Errorf("got %v, want %v", r, want)
+	}
+
+	for _, bad := range []string{"banned", "banned=", "kicked=stop", "banned=panic"} {
+		if _, err := parseReactions(bad); err == nil {
+			t.Errorf("parseReactions(%q) want error", bad)
+		}
+	}
+}
+
+func TestFormatReactions(t *testing.T) {
+	s := formatReactions(map[string]string{"login": "stop", "banned": "ignore", "other": "switch"})
+	if s != "banned=ignore,login=stop,other=switch" {
+		t.Errorf("formatReactions = %q", s)
+	}
+	r, err := parseReactions(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r[POOL_ERROR_LOGIN] != REACT_STOP || r[POOL_ERROR_BANNED] != REACT_IGNORE || r[POOL_ERROR_OTHER] != REACT_SWITCH {
+		t.Errorf("round trip gives %v", r)
+	}
+}
@@ -9,6 +9,13 @@ type JSONRpcReq struct {
 	Params  interface{} `json:"params"`
 }
 
+// JSONRpcReqV1 is the bitcoin style request, pools of that family reject the jsonrpc field
+type JSONRpcReqV1 struct {
+	Id     int         `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
 type LoginParam struct {
 	Login string `json:"login"`
 	Pass  string `json:"pass"`
@@ -59,3 +66,67 @@ type JobReplyData struct {
 	Height   uint64 `json:"height"`
 	SeedHash string `json:"seed_hash"`
 }
+
+///////////////////////////////////////////////////
+
+type JSONRpcRspV1 struct {
+	Id     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+///////////////////////////////////////////////////
+
+type DaemonRsp struct {
+	Id      int              `json:"id"`
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result"`
+	Error   *ErrorReply      `json:"error"`
+}
+
+type BlockTemplateParam struct {
+	WalletAddress string `json:"wallet_address"`
+	ReserveSize   int    `json:"reserve_size"`
+}
+
+type BlockTemplateReply struct {
+	BlocktemplateBlob string `json:"blocktemplate_blob"`
+	BlockhashingBlob  string `json:"blockhashing_blob"`
+	Difficulty        uint64 `json:"difficulty"`
+	Height            uint64 `json:"height"`
+	PrevHash          string `json:"prev_hash"`
+	SeedHash          string `json:"seed_hash"`
+	Status            string `json:"status"`
+}
+
+type SubmitBlockReply struct {
+	Status string `json:"status"`
+}
+
+///////////////////////////////////////////////////
+
+// ServerReq is a request from a downstream miner, params are decoded by method
+type ServerReq struct {
+	Id     int              `json:"id"`
+	Method string           `json:"method"`
+	Params *json.RawMessage `json:"params"`
+}
+
+type ServerRsp struct {
+	Id      int         `json:"id"`
+	JsonRPC string      `json:"jsonrpc"`
+	Result  interface{} `json:"result"`
+	Error   *ErrorReply `json:"error"`
+}
+
+type ServerNotify struct {
+	JsonRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type StatusReply struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,33 @@
+package main
+
+import "github.com/pkg/errors"
+
+const (
+	PROTO_STRATUM  = "stratum"  // monero style login/job/submit
+	PROTO_STRATUM1 = "stratum1" // bitcoin style mining.subscribe/mining.notify/mining.submit
+)
+
+// Protocol is one pool dialect spoken over the Stratum connection, it turns pool messages into *Job for the workers
+type Protocol interface {
+	login() error
+	handle(line []byte) bool
+	submit(result *JobResult) error
+	keepalive()
+}
+
+func checkProtocol(name string) error {
+	switch name {
+	case "", PROTO_STRATUM, PROTO_STRATUM1:
+		return nil
+	}
+	return errors.New("unknown protocol " + name)
+}
+
+// NewProtocol speaks the dialect of pool, which it keeps, a drained connection still answers for its old pool
+func NewProtocol(pool *Pool, s *Stratum) Protocol {
+	switch pool.proto {
+	case PROTO_STRATUM1:
+		return NewStratum1Protocol(pool, s)
+	}
+	return NewXmrProtocol(pool, s)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	kConfigWatchInterval = time.Second * 5
+)
+
+// ConfigReload is the part of the -config file that can change without a restart, command line flags still win
+type ConfigReload struct {
+	set                            map[string]bool
+	user, pass, algo, proto, tlsfp string
+	loglevel                       string
+
+	setPools   func(pools []*Pool) error
+	setThreads func(thread int) // nil when the runner has no workers
+	threads    func() int
+}
+
+// ConfigWatcher reloads the -config file when its mtime changes or on SIGHUP
+type ConfigWatcher struct {
+	file   string
+	mtime  time.Time
+	reload *ConfigReload
+}
+
+func NewConfigWatcher(file string, reload *ConfigReload) *ConfigWatcher {
+	w := &ConfigWatcher{
+		file:   file,
+		reload: reload,
+	}
+	if fi, err := os.Stat(file); err == nil {
+		w.mtime = fi.ModTime()
+	}
+
+	go func() {
+		defer common.CrashLog()
+		w.loop()
+	}()
+
+	return w
+}
+
+func (w *ConfigWatcher) loop() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(kConfigWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			loggo.Info("Config got SIGHUP, reload %v", w.file)
+		case <-ticker.C:
+			fi, err := os.Stat(w.file)
+			if err != nil || fi.ModTime().Equal(w.mtime) {
+				continue
+			}
+			w.mtime = fi.ModTime()
+			loggo.Info("Config %v changed, reload", w.file)
+		}
+
+		c, err := LoadConfig(w.file)
+		if err != nil {
+			loggo.Error("Config reload fail, keep running with the old one: %v", err)
+			continue
+		}
+		w.reload.apply(c)
+	}
+}
+
+// apply changes what differs, a bad pool list is logged and the running one kept
+func (r *ConfigReload) apply(c *Config) {
+	if len(c.Pools) > 0 && !r.set["server"] {
+		pools, err := c.pools(r.set, r.user, r.pass, r.algo, r.proto, r.tlsfp)
+		if err == nil {
+			err = r.setPools(pools)
+		}
+		if err != nil {
+			loggo.Error("Config reload pools fail, keep the running pools: %v", err)
+		}
+	}
+
+	if r.setThreads != nil && !r.set["thread"] {
+		thread := c.threads()
+		if thread > 0 && thread != r.threads() {
+			r.setThreads(thread)
+		}
+	}
+
+	// loggo takes the level once in Ini and has no setter, -loglevel and -config say so
+	if level, ok := c.flags()["loglevel"]; ok && !r.set["loglevel"] && level != r.loglevel {
+		loggo.Warn("Config log level %v -> %v needs a restart to take effect", r.loglevel, level)
+	}
+}
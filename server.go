@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kServerReadTimeout = time.Minute * 10
+)
+
+// ServerHandler serves downstream miners speaking the login/job/submit dialect
+type ServerHandler interface {
+	onLogin(c *ServerConn, login *LoginParam) (*JobReplyData, *ErrorReply)
+	onSubmit(c *ServerConn, id int, submit *SubmitParam)
+	onClose(c *ServerConn)
+}
+
+type StratumServer struct {
+	listener   net.Listener
+	handler    ServerHandler
+	extensions []string // sent at login, nicehash tells the miner the top nonce byte is taken
+	sequence   uint64
+	exit       int32
+}
+
+type ServerConn struct {
+	id     string
+	user   string
+	agent  string
+	conn   net.Conn
+	lock   sync.Mutex
+	login  bool
+	closed int32
+	data   interface{}
+}
+
+func NewStratumServer(addr string, handler ServerHandler, nicehash bool) (*StratumServer, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StratumServer{
+		listener:   listener,
+		handler:    handler,
+		extensions: []string{"algo", "keepalive"},
+	}
+	if nicehash {
+		s.extensions = append(s.extensions, "nicehash")
+	}
+
+	go func() {
+		defer common.CrashLog()
+		s.accept()
+	}()
+
+	loggo.Info("StratumServer listen ok %v", listener.Addr())
+
+	return s, nil
+}
+
+func (s *StratumServer) Close() {
+	atomic.StoreInt32(&s.exit, 1)
+	s.listener.Close()
+}
+
+func (s *StratumServer) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&s.exit) != 0 {
+				return
+			}
+			loggo.Error("StratumServer accept fail %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		c := &ServerConn{
+			id:   strconv.FormatUint(atomic.AddUint64(&s.sequence, 1), 10),
+			conn: conn,
+		}
+
+		loggo.Info("StratumServer accept %v %v", c.id, conn.RemoteAddr())
+
+		go func() {
+			defer common.CrashLog()
+			s.serve(c)
+		}()
+	}
+}
+
+func (s *StratumServer) serve(c *ServerConn) {
+	defer func() {
+		c.close()
+		if c.login {
+			s.handler.onClose(c)
+		}
+		loggo.Info("StratumServer close %v %v", c.id, c.conn.RemoteAddr())
+	}()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(kServerReadTimeout))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			loggo.Info("StratumServer read fail %v %v", c.id, err)
+			return
+		}
+
+		loggo.Debug("StratumServer recv %v %v", c.id, strings.TrimSuffix(line, "\n"))
+
+		var req ServerReq
+		err = json.Unmarshal([]byte(line), &req)
+		if err != nil {
+			loggo.Error("StratumServer Unmarshal fail %v %v", line, err)
+			return
+		}
+
+		if !s.handle(c, &req) {
+			return
+		}
+	}
+}
+
+func (s *StratumServer) handle(c *ServerConn, req *ServerReq) bool {
+	switch req.Method {
+	case "login":
+		var login LoginParam
+		if req.Params == nil || json.Unmarshal(*req.Params, &login) != nil {
+			c.reply(req.Id, nil, &ErrorReply{Code: -1, Message: "Invalid login params"})
+			return false
+		}
+		c.user = login.Login
+		c.agent = login.Agent
+		job, err := s.handler.onLogin(c, &login)
+		if err != nil {
+			c.reply(req.Id, nil, err)
+			return false
+		}
+		c.login = true
+		c.reply(req.Id, &JobReply{
+			Id:         c.id,
+			Job:        job,
+			Extensions: s.extensions,
+			Status:     "OK",
+		}, nil)
+		return true
+	case "submit":
+		if !c.login {
+			c.reply(req.Id, nil, &ErrorReply{Code: -1, Message: "Unauthenticated"})
+			return true
+		}
+		var submit SubmitParam
+		if req.Params == nil || json.Unmarshal(*req.Params, &submit) != nil {
+			c.reply(req.Id, nil, &ErrorReply{Code: -1, Message: "Invalid submit params"})
+			return true
+		}
+		if submit.Id != c.id {
+			c.reply(req.Id, nil, &ErrorReply{Code: -1, Message: "Unauthenticated"})
+			return true
+		}
+		s.handler.onSubmit(c, req.Id, &submit)
+		return true
+	case "keepalived":
+		c.reply(req.Id, &StatusReply{Status: "KEEPALIVED"}, nil)
+		return true
+	}
+
+	loggo.Info("StratumServer unknow method %v %v", c.id, req.Method)
+	c.reply(req.Id, nil, &ErrorReply{Code: -1, Message: "Unsupported method " + req.Method})
+	return true
+}
+
+func (c *ServerConn) write(msg interface{}) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		loggo.Error("StratumServer Marshal fail %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err = c.conn.Write(data)
+	if err != nil {
+		loggo.Info("StratumServer write fail %v %v", c.id, err)
+		c.conn.Close()
+	}
+}
+
+func (c *ServerConn) reply(id int, result interface{}, err *ErrorReply) {
+	c.write(&ServerRsp{
+		Id:      id,
+		JsonRPC: "2.0",
+		Result:  result,
+		Error:   err,
+	})
+}
+
+func (c *ServerConn) sendJob(job *JobReplyData) {
+	c.write(&ServerNotify{
+		JsonRPC: "2.0",
+		Method:  "job",
+		Params:  job,
+	})
+}
+
+func (c *ServerConn) close() {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.conn.Close()
+	}
+}
+
+func (c *ServerConn) String() string {
+	return c.id + "/" + c.user + "/" + c.conn.RemoteAddr().String()
+}
+
+// toJobReplyData turns a job into the login/job wire format, blob may be patched by the caller
+func toJobReplyData(j *Job, blob []byte) *JobReplyData {
+	var target [8]byte
+	for i := 0; i < 8; i++ {
+		target[i] = byte(j.target >> (8 * uint(i)))
+	}
+	_, t := toHex(target[:])
+	_, b := toHex(blob[:j.size])
+	data := &JobReplyData{
+		Blob:   b,
+		JobId:  j.id,
+		Target: t,
+		Algo:   j.algorithm.shortName(),
+		Height: j.height,
+	}
+	if data.Algo == "" {
+		data.Algo = j.algorithm.name()
+	}
+	if j.seed != nil {
+		_, data.SeedHash = toHex(j.seed)
+	}
+	return data
+}
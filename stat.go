@@ -1,13 +1,127 @@
 package main
 
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stat is shared by the workers and the pool client, all counters only grow and are touched atomically
 type Stat struct {
-	hash          uint32
-	job           uint32
-	submitJob     uint32
-	submitJobOK   uint32
-	submitJobFail uint32
+	hashes     uint64
+	jobs       uint64
+	submitted  uint64
+	accepted   uint64
+	stale      uint64 // found on a job that was already gone, dropped before submit or rejected by the pool
+	invalid    uint64 // rejected for any other reason, or never got to the pool
+	reconnects uint64
+	latency    int64 // last submit round trip in nanoseconds
+	poolErrors [POOL_ERROR_COUNT]uint64
+}
+
+// StatSnapshot is a consistent copy of Stat, two snapshots diff into the counts of the period between them
+type StatSnapshot struct {
+	hashes     uint64
+	jobs       uint64
+	submitted  uint64
+	accepted   uint64
+	stale      uint64
+	invalid    uint64
+	reconnects uint64
+	latency    time.Duration
+	poolErrors [POOL_ERROR_COUNT]uint64
+}
+
+func (s *Stat) addHash() {
+	atomic.AddUint64(&s.hashes, 1)
+}
+
+func (s *Stat) addJob() {
+	atomic.AddUint64(&s.jobs, 1)
+}
+
+func (s *Stat) addSubmit() {
+	atomic.AddUint64(&s.submitted, 1)
+}
+
+func (s *Stat) addReconnect() {
+	atomic.AddUint64(&s.reconnects, 1)
+}
+
+func (s *Stat) setLatency(latency time.Duration) {
+	atomic.StoreInt64(&s.latency, int64(latency))
+}
+
+func (s *Stat) addStale() {
+	atomic.AddUint64(&s.stale, 1)
+}
+
+func (s *Stat) addPoolError(kind int) {
+	atomic.AddUint64(&s.poolErrors[kind], 1)
+}
+
+// addResult counts the pool answer to a submit, an empty error means accepted
+func (s *Stat) addResult(err string) {
+	if err == "" {
+		atomic.AddUint64(&s.accepted, 1)
+	} else if classifyPoolError(err) == POOL_ERROR_JOB_NOT_FOUND {
+		atomic.AddUint64(&s.stale, 1)
+	} else {
+		atomic.AddUint64(&s.invalid, 1)
+	}
+}
+
+func (s *Stat) snapshot() StatSnapshot {
+	snap := StatSnapshot{
+		hashes:     atomic.LoadUint64(&s.hashes),
+		jobs:       atomic.LoadUint64(&s.jobs),
+		submitted:  atomic.LoadUint64(&s.submitted),
+		accepted:   atomic.LoadUint64(&s.accepted),
+		stale:      atomic.LoadUint64(&s.stale),
+		invalid:    atomic.LoadUint64(&s.invalid),
+		reconnects: atomic.LoadUint64(&s.reconnects),
+		latency:    time.Duration(atomic.LoadInt64(&s.latency)),
+	}
+	for i := range s.poolErrors {
+		snap.poolErrors[i] = atomic.LoadUint64(&s.poolErrors[i])
+	}
+	return snap
+}
+
+func (a StatSnapshot) sub(b StatSnapshot) StatSnapshot {
+	c := StatSnapshot{
+		hashes:     a.hashes - b.hashes,
+		jobs:       a.jobs - b.jobs,
+		submitted:  a.submitted - b.submitted,
+		accepted:   a.accepted - b.accepted,
+		stale:      a.stale - b.stale,
+		invalid:    a.invalid - b.invalid,
+		reconnects: a.reconnects - b.reconnects,
+		latency:    a.latency,
+	}
+	for i := range c.poolErrors {
+		c.poolErrors[i] = a.poolErrors[i] - b.poolErrors[i]
+	}
+	return c
+}
+
+func (a StatSnapshot) add(b StatSnapshot) StatSnapshot {
+	c := StatSnapshot{
+		hashes:     a.hashes + b.hashes,
+		jobs:       a.jobs + b.jobs,
+		submitted:  a.submitted + b.submitted,
+		accepted:   a.accepted + b.accepted,
+		stale:      a.stale + b.stale,
+		invalid:    a.invalid + b.invalid,
+		reconnects: a.reconnects + b.reconnects,
+		latency:    b.latency,
+	}
+	for i := range c.poolErrors {
+		c.poolErrors[i] = a.poolErrors[i] + b.poolErrors[i]
+	}
+	return c
 }
 
-func (s *Stat) clear() {
-	s.hash = 0
+// rejected leaves out stale shares, those are lost to job changes and not a problem of the miner or the pool
+func (a StatSnapshot) rejected() uint64 {
+	return a.invalid
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	kStateVersion = 1
+	kStateSave    = time.Minute
+)
+
+// StateTotals are the lifetime counters of one pool and algo
+type StateTotals struct {
+	Pool       string            `json:"pool"`
+	Algo       string            `json:"algo"`
+	Uptime     int64             `json:"uptime"` // seconds
+	Hashes     uint64            `json:"hashes"`
+	Jobs       uint64            `json:"jobs"`
+	Submitted  uint64            `json:"submitted"`
+	Accepted   uint64            `json:"accepted"`
+	Stale      uint64            `json:"stale"`
+	Invalid    uint64            `json:"invalid"`
+	Reconnects uint64            `json:"reconnects"`
+	PoolErrors map[string]uint64 `json:"pool_errors"`
+	LastUsed   time.Time         `json:"last_used"`
+}
+
+// State is the -state file, totals accumulate over every session that ran with it
+type State struct {
+	Version    int            `json:"version"`
+	Sessions   uint64         `json:"sessions"`
+	Uptime     int64          `json:"uptime"` // seconds
+	FirstStart time.Time      `json:"first_start"`
+	Updated    time.Time      `json:"updated"`
+	Totals     []*StateTotals `json:"totals"`
+}
+
+func (t *StateTotals) add(s StatSnapshot, uptime time.Duration) {
+	t.Uptime += int64(uptime / time.Second)
+	t.Hashes += s.hashes
+	t.Jobs += s.jobs
+	t.Submitted += s.submitted
+	t.Accepted += s.accepted
+	t.Stale += s.stale
+	t.Invalid += s.invalid
+	t.Reconnects += s.reconnects
+	if t.PoolErrors == nil {
+		t.PoolErrors = make(map[string]uint64)
+	}
+	for kind, name := range kPoolErrorNames {
+		if s.poolErrors[kind] > 0 {
+			t.PoolErrors[name] += s.poolErrors[kind]
+		}
+	}
+}
+
+// LoadState reads the state file, a missing file is an empty state
+func LoadState(file string) (*State, error) {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return &State{Version: kStateVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var st State
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad state file "+file)
+	}
+	if st.Version > kStateVersion {
+		return nil, errors.New("state file " + file + " is from a newer version")
+	}
+	st.Version = kStateVersion
+	return &st, nil
+}
+
+// save writes a temp file and renames it over the old one, so a crash never leaves half a state
+func (st *State) save(file string) error {
+	data, err := json.MarshalIndent(st, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (st *State) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Sessions %v, Uptime %v, Since %v, Updated %v\n", st.Sessions, time.Duration(st.Uptime)*time.Second,
+		st.FirstStart.Format(time.RFC3339), st.Updated.Format(time.RFC3339))
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tALGO\tUPTIME\tHASHES\tSUBMITTED\tACCEPTED\tSTALE\tINVALID\tRECONNECTS\tLAST USED")
+	total := &StateTotals{Pool: "total"}
+	for _, t := range st.Totals {
+		writeStateTotals(w, t)
+		total.Uptime += t.Uptime
+		total.Hashes += t.Hashes
+		total.Submitted += t.Submitted
+		total.Accepted += t.Accepted
+		total.Stale += t.Stale
+		total.Invalid += t.Invalid
+		total.Reconnects += t.Reconnects
+		if t.LastUsed.After(total.LastUsed) {
+			total.LastUsed = t.LastUsed
+		}
+	}
+	writeStateTotals(w, total)
+	w.Flush()
+	return b.String()
+}
+
+func writeStateTotals(w *tabwriter.Writer, t *StateTotals) {
+	last := "-"
+	if !t.LastUsed.IsZero() {
+		last = t.LastUsed.Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", t.Pool, t.Algo, time.Duration(t.Uptime)*time.Second,
+		t.Hashes, t.Submitted, t.Accepted, t.Stale, t.Invalid, t.Reconnects, last)
+}
+
+type LifetimeSession struct {
+	stat   StatSnapshot
+	uptime time.Duration
+	last   time.Time
+}
+
+// Lifetime splits the counters of this session by the pool and algo that were current when they grew,
+// and adds them to the totals loaded from the state file when saving. Run updates it every second, /metrics reads it
+type Lifetime struct {
+	file  string // empty keeps the session in memory only
+	base  *State
+	start time.Time
+
+	lock     sync.Mutex
+	last     StatSnapshot
+	lastTime time.Time
+	lastSave time.Time
+	session  map[MetricsLabels]*LifetimeSession
+}
+
+func NewLifetime(file string) (*Lifetime, error) {
+	l := &Lifetime{
+		file:    file,
+		base:    &State{Version: kStateVersion},
+		start:   time.Now(),
+		session: make(map[MetricsLabels]*LifetimeSession),
+	}
+	l.lastTime = l.start
+	l.lastSave = l.start
+	if file != "" {
+		st, err := LoadState(file)
+		if err != nil {
+			return nil, err
+		}
+		l.base = st
+	}
+	return l, nil
+}
+
+// update gives everything counted since the last update to the pool and algo in use
+func (l *Lifetime) update(label MetricsLabels, now StatSnapshot) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.updateAt(label, now, time.Now())
+}
+
+func (l *Lifetime) updateAt(label MetricsLabels, now StatSnapshot, t time.Time) {
+	s, ok := l.session[label]
+	if !ok {
+		s = &LifetimeSession{}
+		l.session[label] = s
+	}
+	s.stat = s.stat.add(now.sub(l.last))
+	s.uptime += t.Sub(l.lastTime)
+	s.last = t
+	l.last = now
+	l.lastTime = t
+}
+
+// labels are the pools and algos used this session, in order, called under lock
+func (l *Lifetime) labels() []MetricsLabels {
+	keys := make([]MetricsLabels, 0, len(l.session))
+	for k := range l.session {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pool != keys[j].pool {
+			return keys[i].pool < keys[j].pool
+		}
+		return keys[i].algo < keys[j].algo
+	})
+	return keys
+}
+
+// sessions copies the counters of this session, in the order of labels
+func (l *Lifetime) sessions() ([]MetricsLabels, []LifetimeSession) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	keys := l.labels()
+	sessions := make([]LifetimeSession, len(keys))
+	for i, k := range keys {
+		sessions[i] = *l.session[k]
+	}
+	return keys, sessions
+}
+
+// state is the loaded totals plus this session
+func (l *Lifetime) state() *State {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	st := &State{
+		Version:    kStateVersion,
+		Sessions:   l.base.Sessions + 1,
+		Uptime:     l.base.Uptime + int64(l.lastTime.Sub(l.start)/time.Second),
+		FirstStart: l.base.FirstStart,
+		Updated:    l.lastTime,
+	}
+	if st.FirstStart.IsZero() {
+		st.FirstStart = l.start
+	}
+
+	totals := make(map[MetricsLabels]*StateTotals)
+	for _, t := range l.base.Totals {
+		c := *t
+		c.PoolErrors = make(map[string]uint64)
+		for k, v := range t.PoolErrors {
+			c.PoolErrors[k] = v
+		}
+		totals[MetricsLabels{pool: t.Pool, algo: t.Algo}] = &c
+		st.Totals = append(st.Totals, &c)
+	}
+	for _, k := range l.labels() {
+		s := l.session[k]
+		t, ok := totals[k]
+		if !ok {
+			t = &StateTotals{Pool: k.pool, Algo: k.algo}
+			totals[k] = t
+			st.Totals = append(st.Totals, t)
+		}
+		t.add(s.stat, s.uptime)
+		t.LastUsed = s.last
+	}
+	return st
+}
+
+// save writes the state file every kStateSave, or now when force
+func (l *Lifetime) save(force bool) error {
+	if l.file == "" {
+		return nil
+	}
+	l.lock.Lock()
+	if !force && time.Now().Sub(l.lastSave) < kStateSave {
+		l.lock.Unlock()
+		return nil
+	}
+	l.lastSave = time.Now()
+	l.lock.Unlock()
+	return l.state().save(l.file)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateLoadMissing(t *testing.T) {
+	st, err := LoadState(filepath.Join(t.TempDir(), "none.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Version != kStateVersion || st.Sessions != 0 || len(st.Totals) != 0 {
+		t.Errorf("missing file loaded %+v", st)
+	}
+}
+
+func TestStateLoadBad(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"garbage", "{", "bad state file"},
+		{"newer", `{"version":99}`, "newer version"},
+	}
+	for _, tt := range tests {
+		file := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(file, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadState(file)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%v: got %v want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// TestLifetimeAccumulate runs two sessions on one state file, the second adds to the totals of the first
+func TestLifetimeAccumulate(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	a := MetricsLabels{pool: "a:1", algo: "cn/0"}
+	b := MetricsLabels{pool: "b:2", algo: "cn/r"}
+
+	l, err := NewLifetime(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := StatSnapshot{hashes: 100, submitted: 2, accepted: 2}
+	first.poolErrors[POOL_ERROR_LOW_DIFFICULTY] = 1
+	l.updateAt(a, first, l.start.Add(time.Second*10))
+	second := first
+	second.hashes = 130
+	second.stale = 1
+	l.updateAt(b, second, l.start.Add(time.Second*15))
+	if err := l.save(true); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = NewLifetime(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.updateAt(a, StatSnapshot{hashes: 50, accepted: 1}, l.start.Add(time.Second*20))
+	if err := l.save(true); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := LoadState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Sessions != 2 || st.Uptime != 35 {
+		t.Errorf("Sessions=%v Uptime=%v, want 2 35", st.Sessions, st.Uptime)
+	}
+	if len(st.Totals) != 2 {
+		t.Fatalf("%v totals, want 2", len(st.Totals))
+	}
+	for _, tt := range []struct {
+		label    MetricsLabels
+		uptime   int64
+		hashes   uint64
+		accepted uint64
+		stale    uint64
+		lowdiff  uint64
+	}{
+		{a, 30, 150, 3, 0, 1},
+		{b, 5, 30, 0, 1, 0},
+	} {
+		var got *StateTotals
+		for _, tot := range st.Totals {
+			if tot.Pool == tt.label.pool && tot.Algo == tt.label.algo {
+				got = tot
+			}
+		}
+		if got == nil {
+			t.Errorf("no totals for %v", tt.label)
+			continue
+		}
+		if got.Uptime != tt.uptime || got.Hashes != tt.hashes || got.Accepted != tt.accepted || got.Stale != tt.stale ||
+			got.PoolErrors["low-difficulty"] != tt.lowdiff {
+			t.Errorf("%v totals %+v", tt.label, got)
+		}
+	}
+
+	if s := st.String(); !strings.Contains(s, "Sessions 2") || !strings.Contains(s, "total") {
+		t.Errorf("stats print\n%v", s)
+	}
+}
+
+func TestLifetimeSaveInterval(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	l, err := NewLifetime(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.save(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("saved before %v: %v", kStateSave, err)
+	}
+	l.lastSave = l.lastSave.Add(-kStateSave)
+	if err := l.save(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("not saved after %v: %v", kStateSave, err)
+	}
+
+	// without a file nothing is written
+	l, err = NewLifetime("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.save(true); err != nil {
+		t.Fatal(err)
+	}
+}
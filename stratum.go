@@ -2,304 +2,635 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"github.com/esrrhs/gohome/common"
 	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"math/rand"
 	"net"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	STRATUM_CONNECTING = iota
+	STRATUM_CONNECTED
+	STRATUM_DISCONNECTED
+	STRATUM_STOPPED
+)
+
+const (
+	kStratumDrainTimeout   = time.Second * 10
+	kStratumLoginTimeout   = time.Second * 10
+	kStratumSubmitTimeout  = time.Second * 30
+	kStratumRequestTimeout = time.Second * 30
+)
+
+type StratumConfig struct {
+	retries     int           // failover to next pool after this many failed connects
+	maxRetries  int           // give up after this many failed reconnects in a row, 0 means forever
+	backoff     time.Duration // first reconnect delay, doubled on every failure
+	backoffMax  time.Duration
+	probe       time.Duration         // how often the primary pool is probed after failover
+	proxy       *url.URL              // socks5 or http connect proxy, nil dials directly
+	agent       string                // user agent sent at login
+	background  bool                  // keep retrying when no pool answers at startup instead of failing
+	reactions   [POOL_ERROR_COUNT]int // REACT_* for every POOL_ERROR_* kind
+	submitStale bool                  // still submit shares of the previous job, for pools that take them for a while
+}
+
+// StratumRequest is a request the pool has not answered yet
+type StratumRequest struct {
+	id      int
+	method  string
+	sent    time.Time
+	timeout time.Duration
+	result  *JobResult // the share of a submit, nil for other methods
+}
+
 type Stratum struct {
-	pool     string
-	alg      *Algorithm
-	user     string
-	pass     string
-	agent    string
-	rigid    string
-	rpcid    string
-	sequence int
-
-	ext_algo      bool
-	ext_nicehash  bool
-	ext_connect   bool
-	ext_keepalive bool
-
-	conn   net.Conn
+	pools     []*Pool
+	cur       int
+	fails     int
+	cfg       StratumConfig
+	attempts  int
+	status    int32
+	probing   int32
+	draining  int32 // the connection is left for another pool, closing it is no failure
+	pinned    bool  // picked by hand, don't probe back to the primary
+	lastProbe time.Time
+	agent     string
+	err       error // why the last connect or login failed
+
+	ctx    context.Context // cancelled by stop, no reconnect or new job after that
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // the listen goroutine
+
+	proto  Protocol // replaced by every reconnect like conn, use getProto
+	conn   net.Conn // swapped by the reconnecting goroutine, use getConn/closeConn elsewhere
 	reader *bufio.Reader
 	jobs   chan *Job
 	lock   sync.Mutex
+	plock  sync.Mutex
+
+	ids     int64 // last request id, 0 is never sent so a notification can't be taken for an answer
+	rlock   sync.Mutex
+	pending map[int]*StratumRequest
 
-	submits sync.Map
-	stat    *Stat
+	stat *Stat
 }
 
-func NewStratum(pool string, alg *Algorithm, user string, pass string, jobs chan *Job, stat *Stat) (*Stratum, error) {
+func NewStratum(pools []*Pool, cfg StratumConfig, jobs chan *Job, stat *Stat) (*Stratum, error) {
 	var s Stratum
-	s.user = user
-	s.pass = pass
-	s.alg = alg
-	s.pool = pool
+	s.pools = pools
+	s.cfg = cfg
+	s.agent = cfg.agent
 	s.jobs = jobs
 	s.stat = stat
-	s.sequence = 1
+	s.pending = make(map[int]*StratumRequest)
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 
-	err := s.Reconnect()
-	if err != nil {
-		loggo.Error("Stratum New fail %v %v", s.pool, err)
-		return nil, nil
+	if s.cfg.retries <= 0 {
+		s.cfg.retries = 1
+	}
+	if s.cfg.backoff <= 0 {
+		s.cfg.backoff = time.Second
+	}
+	if s.cfg.backoffMax < s.cfg.backoff {
+		s.cfg.backoffMax = s.cfg.backoff
 	}
 
-	go s.listen()
-
-	loggo.Info("Stratum New ok")
+	var err error
+	for i := range s.pools {
+		s.switchPool(i)
+		err = s.Reconnect()
+		if err == nil {
+			err = s.handshake()
+		}
+		if err == nil || s.state() == STRATUM_STOPPED {
+			break
+		}
+	}
+	if err != nil {
+		if !s.cfg.background || s.state() == STRATUM_STOPPED {
+			loggo.Error("Stratum New fail %v", err)
+			return nil, err
+		}
+		loggo.Warn("Stratum New fail %v, keep retrying in background", err)
+		s.setState(STRATUM_DISCONNECTED)
+		s.wg.Add(1)
+		go func() {
+			defer common.CrashLog()
+			defer s.wg.Done()
+			if s.reconnectLoop() {
+				s.listen()
+			}
+		}()
+		return &s, nil
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer common.CrashLog()
+		defer s.wg.Done()
+		s.listen()
+	}()
+
+	loggo.Info("Stratum New ok %v", s.current())
 
 	return &s, nil
 }
 
-func (s *Stratum) Reconnect() error {
-
-	loggo.Info("Stratum New start Using user %v pass %v pool %v", s.user, s.pass, s.pool)
+func (s *Stratum) current() *Pool {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.pools[s.cur]
+}
 
-	if s.conn != nil {
-		s.conn.Close()
-	}
+// poolList returns the failover list in use, the config reload may swap it at any time
+func (s *Stratum) poolList() []*Pool {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.pools
+}
 
-	conn, err := net.Dial("tcp", s.pool)
-	if err != nil {
-		loggo.Error("Stratum Dial fail %v %v", s.pool, err)
-		return err
+func (s *Stratum) switchPool(index int) {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	if index != s.cur {
+		loggo.Warn("Stratum switch pool %v -> %v", s.pools[s.cur], s.pools[index])
 	}
-	s.conn = conn
+	s.cur = index
+	s.fails = 0
+	s.lastProbe = time.Now()
+}
 
-	loggo.Info("Stratum pool connect ok %v->%v", conn.LocalAddr(), conn.RemoteAddr())
+func (s *Stratum) failover() {
+	s.plock.Lock()
+	next := (s.cur + 1) % len(s.pools)
+	s.pinned = false
+	s.plock.Unlock()
+	s.switchPool(next)
+}
 
-	s.reader = bufio.NewReader(s.conn)
+// usePool moves to a pool picked by hand, the primary is not probed until this pool fails,
+// the old connection is kept until the submits in flight are answered
+func (s *Stratum) usePool(index int) error {
+	s.plock.Lock()
+	if index < 0 || index >= len(s.pools) {
+		s.plock.Unlock()
+		return errors.New("no pool " + strconv.Itoa(index))
+	}
+	s.pinned = index != 0
+	same := index == s.cur
+	s.plock.Unlock()
+	if same {
+		return nil
+	}
+	s.switchPool(index)
+	go s.drain()
+	return nil
+}
 
-	err = s.login()
+// setPools takes a reloaded failover list, the connection is kept when its pool is still the one to use,
+// otherwise the new primary is used once the submits in flight have been answered
+func (s *Stratum) setPools(pools []*Pool) error {
+	err := checkPoolList(pools, false)
 	if err != nil {
-		loggo.Error("Stratum login fail %v", err)
 		return err
 	}
+
+	s.plock.Lock()
+	old := s.pools[s.cur]
+	cur := reselect(pools, old, s.cur)
+	s.pools = pools
+	s.fails = 0
+	if cur >= 0 {
+		s.cur = cur
+		s.plock.Unlock()
+		loggo.Info("Stratum pools reloaded, %v pools, keep %v", len(pools), old)
+		return nil
+	}
+	s.cur = 0
+	s.pinned = false
+	s.lastProbe = time.Now()
+	s.plock.Unlock()
+
+	loggo.Warn("Stratum pools reloaded, %v pools, switch %v -> %v", len(pools), old, pools[0])
+	go s.drain()
 	return nil
 }
 
-func (s *Stratum) listen() {
+// drain closes the connection after the pool answered the submits sent so far, or after kStratumDrainTimeout,
+// listen then reconnects to the current pool
+func (s *Stratum) drain() {
 	defer common.CrashLog()
 
-	loggo.Info("Stratum Starting Listener")
+	atomic.StoreInt32(&s.draining, 1)
+	left := s.waitSubmits(time.Now().Add(kStratumDrainTimeout))
 
-	for {
-		result, err := s.reader.ReadString('\n')
-		if err != nil {
-			loggo.Error("Stratum Connection lost %v", err)
-			time.Sleep(time.Second)
-			s.Reconnect()
-			continue
-		}
+	loggo.Info("Stratum drained submits, %v unanswered, reconnect", left)
+	s.closeConn()
+}
 
-		loggo.Debug("Stratum recv %v", strings.TrimSuffix(result, "\n"))
-		var rsp JSONRpcRsp
-		err = json.Unmarshal([]byte(result), &rsp)
-		if err != nil {
-			loggo.Error("Stratum Unmarshal fail %v %v", result, err)
-			continue
-		}
+func (s *Stratum) getConn() net.Conn {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.conn
+}
 
-		if !s.handleRsp(rsp) {
-			loggo.Error("Stratum handleRsp fail %v", result)
-			continue
-		}
-	}
+// getProto is the protocol of the current connection, submit and hb run beside the reconnecting goroutine
+func (s *Stratum) getProto() Protocol {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.proto
 }
 
-func (s *Stratum) handleRsp(rsp JSONRpcRsp) bool {
-	loggo.Debug("Stratum handleRsp %v", rsp.Id)
-	err := rsp.Error
-	if err != nil {
-		s.handleSubmitResponse(rsp.Id, err.Message)
-		loggo.Error("Stratum handleRsp error %v", err)
-		return false
+// closeConn closes the connection so listen reconnects, there is none yet while NewStratum retries in background
+func (s *Stratum) closeConn() {
+	conn := s.getConn()
+	if conn != nil {
+		conn.Close()
 	}
-	id := rsp.Id
-	if id != 0 {
-		return s.handleResponse(id, rsp)
+}
+
+// waitSubmits waits until the pool answered the submits sent so far or deadline, returns how many are left
+func (s *Stratum) waitSubmits(deadline time.Time) int {
+	var ids []int
+	s.rlock.Lock()
+	for id, req := range s.pending {
+		if req.result != nil {
+			ids = append(ids, id)
+		}
 	}
+	s.rlock.Unlock()
 
-	return s.handleNotify(rsp)
+	left := 0
+	for _, id := range ids {
+		// a stopped connection won't answer any more
+		for time.Now().Before(deadline) && s.isPending(id) && s.state() != STRATUM_STOPPED {
+			time.Sleep(time.Millisecond * 100)
+		}
+		if s.isPending(id) {
+			left++
+		}
+	}
+	return left
 }
 
-func (s *Stratum) handleNotify(rsp JSONRpcRsp) bool {
-	loggo.Debug("Stratum handleNotify %v", rsp.Method)
+// stop waits until deadline for the answers to the submits in flight, then closes the connection for good
+func (s *Stratum) stop(deadline time.Time) {
+	s.cancel()
 
-	if rsp.Method == "" {
-		loggo.Error("Stratum handleNotify no method")
-		return false
-	}
+	left := s.waitSubmits(deadline)
 
-	m := rsp.Method
-	if m == "job" {
-		return s.handleNotifyJob(rsp)
+	s.setState(STRATUM_STOPPED)
+	s.closeConn()
+
+	done := make(chan struct{})
+	go func() {
+		defer common.CrashLog()
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		loggo.Warn("Stratum listener still running")
 	}
 
-	return true
+	loggo.Info("Stratum stopped %v, %v submits unanswered", s.current(), left)
 }
 
-func (s *Stratum) handleNotifyJob(rsp JSONRpcRsp) bool {
-	loggo.Debug("Stratum handleNotifyJob %v", rsp.Method)
+func (s *Stratum) Reconnect() error {
+
+	pool := s.current()
 
-	if rsp.Params == nil {
-		loggo.Error("Stratum handleNotifyJob no Params")
-		return false
-	}
+	s.setState(STRATUM_CONNECTING)
+
+	loggo.Info("Stratum New start Using user %v pass %v pool %v tls %v", pool.user, pool.pass, pool.url, pool.tls)
 
-	var job JobReplyData
-	err := json.Unmarshal(*rsp.Params, &job)
+	s.closeConn()
+
+	conn, err := dialPool(s.cfg.proxy, pool.host, pool.tls, pool.tlsfp)
 	if err != nil {
-		loggo.Error("Stratum handleNotifyJob Unmarshal fail %v", err)
-		return false
+		loggo.Error("Stratum Dial fail %v %v", pool.url, err)
+		err = &DialError{Pool: pool.url, Err: err}
+		s.connectFail(err)
+		return err
 	}
+	proto := NewProtocol(pool, s)
+	s.plock.Lock()
+	s.conn = conn
+	s.proto = proto
+	s.plock.Unlock()
+	atomic.StoreInt32(&s.draining, 0)
 
-	return s.parseJob(&job)
-}
+	loggo.Info("Stratum pool connect ok %v->%v", conn.LocalAddr(), conn.RemoteAddr())
 
-func (s *Stratum) handleResponse(id int, rsp JSONRpcRsp) bool {
-	loggo.Debug("Stratum handleResponse %v", id)
-	if id == 1 {
-		return s.handleLogin(rsp)
-	}
+	s.reader = bufio.NewReader(conn)
 
-	return s.handleSubmitResponse(id, "")
+	err = proto.login()
+	if err != nil {
+		loggo.Error("Stratum login fail %v", err)
+		err = &DialError{Pool: pool.url, Err: err}
+		s.connectFail(err)
+		return err
+	}
+	return nil
 }
 
-func (s *Stratum) handleSubmitResponse(id int, error string) bool {
-	loggo.Debug("Stratum handleSubmitResponse %v %v", id, error)
+// handshake reads the pool until the login is answered, so NewStratum can tell a refused login from a pool that is down
+func (s *Stratum) handshake() error {
+	pool := s.current()
+	s.plock.Lock()
+	s.err = nil
+	s.plock.Unlock()
 
-	v, ok := s.submits.Load(id)
-	if ok {
-		s.submits.Delete(id)
-		result := v.(*JobResult)
-		elapse := time.Now().Sub(result.submit)
-		if error != "" {
-			atomic.AddUint32(&s.stat.submitJobFail, 1)
-			loggo.Error("Stratum Submit Job Fail %v %v %v", error, result.job.id, elapse)
-		} else {
-			atomic.AddUint32(&s.stat.submitJobOK, 1)
-			loggo.Warn("Stratum Submit Job OK %v %v", result.job.id, elapse)
+	conn := s.getConn()
+	conn.SetReadDeadline(time.Now().Add(kStratumLoginTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for s.state() != STRATUM_CONNECTED {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			// loginFail closes the connection, the read error is only the consequence
+			if e := s.lastError(); e != nil {
+				return e
+			}
+			err = &ProtocolError{Pool: pool.url, Err: errors.Wrap(err, "no login reply")}
+			s.connectFail(err)
+			return err
+		}
+
+		loggo.Debug("Stratum recv %v", strings.TrimSuffix(line, "\n"))
+		if !s.getProto().handle([]byte(line)) {
+			loggo.Error("Stratum handle fail %v", line)
 		}
 	}
+	return nil
+}
 
-	return true
+// lastError is why the pool was last given up on, nil after a good login
+func (s *Stratum) lastError() error {
+	s.plock.Lock()
+	defer s.plock.Unlock()
+	return s.err
 }
 
-func (s *Stratum) handleLogin(rsp JSONRpcRsp) bool {
-	result := rsp.Result
-	if result == nil {
-		loggo.Error("Stratum handleLogin no result")
-		return false
+func (s *Stratum) connectFail(err error) {
+	s.plock.Lock()
+	s.err = err
+	s.fails++
+	fails := s.fails
+	n := len(s.pools)
+	s.plock.Unlock()
+	if fails >= s.cfg.retries && n > 1 {
+		loggo.Error("Stratum pool %v failed %v times, failover", s.current(), fails)
+		s.failover()
 	}
+}
 
-	loggo.Debug("Stratum handleLogin rsp")
-
-	if result.Id == "" {
-		loggo.Error("Stratum handleLogin no Id")
-		return false
+// loginFail takes a *LoginError when the pool refused us, which reacts by its kind, or a *ProtocolError which fails over
+func (s *Stratum) loginFail(err error) {
+	s.plock.Lock()
+	s.err = err
+	s.plock.Unlock()
+
+	var login *LoginError
+	if errors.As(err, &login) {
+		kind := classifyPoolError(login.Message)
+		if kind != POOL_ERROR_BANNED {
+			kind = POOL_ERROR_LOGIN
+		}
+		s.stat.addPoolError(kind)
+		react := s.cfg.reactions[kind]
+		if react == REACT_IGNORE {
+			// there is no session to keep
+			react = REACT_RELOGIN
+		}
+		s.react(kind, react, login.Message)
+		return
 	}
 
-	s.rpcid = result.Id
-
-	if !s.parseExtensions(result) {
-		loggo.Error("Stratum parseExtensions fail")
-		return false
+	if len(s.poolList()) > 1 {
+		loggo.Error("Stratum pool %v login fail, failover", s.current())
+		s.failover()
 	}
+	s.closeConn()
+}
 
-	if !s.parseJob(result.Job) {
-		loggo.Error("Stratum parseJob fail")
-		return false
-	}
+// poolError counts an error the pool answered a request with and reacts as configured for its kind
+func (s *Stratum) poolError(msg string) {
+	kind := classifyPoolError(msg)
+	s.stat.addPoolError(kind)
+	s.react(kind, s.cfg.reactions[kind], msg)
+}
 
-	loggo.Info("Stratum handleLogin ok")
+func (s *Stratum) react(kind int, react int, msg string) {
+	pool := s.current()
+	switch react {
+	case REACT_IGNORE:
+		return
+	case REACT_RELOGIN:
+		loggo.Warn("Stratum %v error from %v, login again: %v", kPoolErrorNames[kind], pool, msg)
+	case REACT_SWITCH:
+		if len(s.poolList()) > 1 {
+			loggo.Warn("Stratum %v error from %v, failover: %v", kPoolErrorNames[kind], pool, msg)
+			s.failover()
+		} else {
+			loggo.Warn("Stratum %v error from %v, no other pool, login again: %v", kPoolErrorNames[kind], pool, msg)
+		}
+	case REACT_STOP:
+		loggo.Error("Stratum %v error from %v, stop: %v", kPoolErrorNames[kind], pool, msg)
+		s.plock.Lock()
+		s.err = &PoolError{Pool: pool.url, Kind: kind, Message: msg}
+		s.plock.Unlock()
+		s.setState(STRATUM_STOPPED)
+	}
+	s.closeConn()
+}
 
-	return true
+func (s *Stratum) loginOk() {
+	s.plock.Lock()
+	s.err = nil
+	s.plock.Unlock()
+	s.attempts = 0
+	s.setState(STRATUM_CONNECTED)
 }
 
-func (s *Stratum) parseJob(job *JobReplyData) bool {
-	j := &Job{
-		algorithm: s.alg,
-		nicehash:  s.ext_nicehash,
-		clientId:  s.rpcid,
+func (s *Stratum) newJob(j *Job) {
+	if s.ctx.Err() != nil {
+		return
 	}
+	s.jobs <- j
+	s.stat.addJob()
 
-	if job.JobId == "" {
-		loggo.Error("Stratum parseJob no JobId")
-		return false
+	loggo.Info("Stratum parseJob ok id=%v algo=%v height=%v target=%v diff=%v", j.id, j.algorithm.name(), j.height, j.target, j.diff)
+}
+
+func (s *Stratum) listen() {
+	defer common.CrashLog()
+
+	loggo.Info("Stratum Starting Listener")
+
+	for {
+		result, err := s.reader.ReadString('\n')
+		if err != nil {
+			if s.ctx.Err() != nil {
+				loggo.Info("Stratum listener closed")
+				return
+			}
+			if s.state() == STRATUM_STOPPED {
+				loggo.Error("Stratum stopped, %v", s.lastError())
+				return
+			}
+			if atomic.LoadInt32(&s.draining) != 0 {
+				loggo.Info("Stratum drained connection closed, connect %v", s.current())
+			} else {
+				loggo.Error("Stratum Connection lost %v", err)
+			}
+			s.expire("connection lost", true)
+			s.setState(STRATUM_DISCONNECTED)
+			if !s.reconnectLoop() {
+				return
+			}
+			continue
+		}
+
+		loggo.Debug("Stratum recv %v", strings.TrimSuffix(result, "\n"))
+		if !s.getProto().handle([]byte(result)) {
+			loggo.Error("Stratum handle fail %v", result)
+			continue
+		}
 	}
-	j.id = job.JobId
+}
 
-	if job.Algo != "" {
-		j.algorithm = NewAlgorithm(job.Algo)
-		if j.algorithm == nil {
-			loggo.Error("Stratum parseJob fail Algorithm %v", job.Algo)
+func (s *Stratum) reconnectLoop() bool {
+	// a drained connection was closed on purpose, the new pool is dialed right away
+	now := atomic.LoadInt32(&s.draining) != 0
+	for {
+		if s.state() == STRATUM_STOPPED || s.ctx.Err() != nil {
 			return false
 		}
-	} else {
-		if j.algorithm == nil {
-			loggo.Error("Stratum no default Algorithm")
+		if s.cfg.maxRetries > 0 && s.attempts >= s.cfg.maxRetries {
+			loggo.Error("Stratum reconnect fail %v times, give up", s.attempts)
+			s.setState(STRATUM_STOPPED)
 			return false
 		}
+
+		if !now {
+			delay := s.backoffDelay(s.attempts)
+			s.attempts++
+			s.stat.addReconnect()
+			loggo.Warn("Stratum reconnect %v in %v", s.attempts, delay)
+			select {
+			case <-s.ctx.Done():
+				return false
+			case <-time.After(delay):
+			}
+		}
+		now = false
+
+		if s.Reconnect() == nil {
+			if s.ctx.Err() != nil {
+				// stopped while dialing
+				s.closeConn()
+				return false
+			}
+			return true
+		}
 	}
+}
 
-	if !j.setBlob(job.Blob) {
-		loggo.Error("Stratum parseJob fail Blob %v", job.Blob)
-		return false
+// backoffDelay doubles the delay on every attempt, with jitter in [delay/2, delay] so rigs don't reconnect in lockstep
+func (s *Stratum) backoffDelay(attempt int) time.Duration {
+	delay := s.cfg.backoff
+	// double step by step, a shift overflows long before attempt 32 with a backoff of a few seconds
+	for i := 0; i < attempt && delay < s.cfg.backoffMax; i++ {
+		if delay > s.cfg.backoffMax/2 {
+			delay = s.cfg.backoffMax
+		} else {
+			delay *= 2
+		}
 	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-	if !j.setTarget(job.Target) {
-		loggo.Error("Stratum parseJob fail Target %v", job.Target)
-		return false
+func (s *Stratum) setState(state int32) {
+	old := atomic.SwapInt32(&s.status, state)
+	if old == state {
+		return
+	}
+	if state == STRATUM_DISCONNECTED && s.ctx.Err() == nil {
+		// a nil job tells the miner to pause workers until a fresh job arrives
+		s.jobs <- nil
 	}
+}
 
-	j.height = job.Height
+func (s *Stratum) state() int32 {
+	return atomic.LoadInt32(&s.status)
+}
 
-	if j.algorithm.family() == RANDOM_X {
-		if !j.setSeedHash(job.SeedHash) {
-			loggo.Error("Stratum parseJob fail SeedHash %v", job.SeedHash)
-			return false
-		}
-	}
+func (s *Stratum) stateName() string {
+	switch s.state() {
+	case STRATUM_CONNECTING:
+		return "connecting"
+	case STRATUM_CONNECTED:
+		return "connected"
+	case STRATUM_DISCONNECTED:
+		return "disconnected"
+	case STRATUM_STOPPED:
+		return "stopped"
+	}
+	return "unknown"
+}
 
-	s.jobs <- j
-	atomic.AddUint32(&s.stat.job, 1)
+// handleSubmitResponse takes the pool answer to a submit, an empty error means accepted
+func (s *Stratum) handleSubmitResponse(req *StratumRequest, error string) bool {
+	loggo.Debug("Stratum handleSubmitResponse %v %v", req.id, error)
 
-	loggo.Info("Stratum parseJob ok id=%v algo=%v height=%v target=%v diff=%v", j.id, j.algorithm.name(), j.height, j.target, j.diff)
+	result := req.result
+	elapse := time.Now().Sub(req.sent)
+	s.stat.setLatency(elapse)
+	s.stat.addResult(error)
+	if error != "" {
+		loggo.Error("Stratum Submit Job Fail %v %v %v", error, result.job.id, elapse)
+	} else {
+		loggo.Warn("Stratum Submit Job OK %v %v", result.job.id, elapse)
+	}
+	if result.done != nil {
+		result.done(error)
+	}
+
+	if error != "" {
+		s.poolError(error)
+	}
 
 	return true
 }
 
-func (s *Stratum) parseExtensions(result *JobReply) bool {
-	for _, name := range result.Extensions {
-		if name == "algo" {
-			s.ext_algo = true
-		} else if name == "nicehash" {
-			s.ext_nicehash = true
-		} else if name == "connect" {
-			s.ext_connect = true
-		} else if name == "keepalive" {
-			s.ext_keepalive = true
-		} else {
-			loggo.Info("Stratum parseExtensions unknow %v", name)
-		}
+// handleAnswer takes the answer to a request that is not part of the login, req is nil for an id not pending,
+// errors to anything but a submit, e.g. a keepalive after the pool lost the session, still count as pool errors
+func (s *Stratum) handleAnswer(id int, req *StratumRequest, error string) bool {
+	if req != nil && req.result != nil {
+		return s.handleSubmitResponse(req, error)
+	}
+	if req == nil {
+		loggo.Warn("Stratum answer to unknown request %v %v", id, error)
+	}
+	if error != "" {
+		s.poolError(error)
 	}
 	return true
 }
 
 func (s *Stratum) send(id int, method string, p interface{}) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-
 	m, err := json.Marshal(p)
 	if err != nil {
 		loggo.Error("Stratum send Marshal fail %v", err)
@@ -313,91 +644,191 @@ func (s *Stratum) send(id int, method string, p interface{}) error {
 		Params:  (*json.RawMessage)(&m),
 	}
 
-	reqm, err := json.Marshal(&req)
+	return s.write(&req)
+}
+
+func (s *Stratum) sendV1(id int, method string, p interface{}) error {
+	req := JSONRpcReqV1{
+		Id:     id,
+		Method: method,
+		Params: p,
+	}
+	return s.write(&req)
+}
+
+func (s *Stratum) write(req interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reqm, err := json.Marshal(req)
 	if err != nil {
 		loggo.Error("Stratum send Marshal fail %v", err)
 		return err
 	}
 
-	_, err = s.conn.Write(reqm)
+	conn := s.getConn()
+	if conn == nil {
+		return errors.New("not connected")
+	}
+
+	_, err = conn.Write(reqm)
 	if err != nil {
 		loggo.Error("Stratum send Write fail %v", err)
 		return err
 	}
 
-	_, err = s.conn.Write([]byte("\n"))
+	_, err = conn.Write([]byte("\n"))
 	if err != nil {
 		loggo.Error("Stratum send Write fail %v", err)
 		return err
 	}
 
-	s.sequence++
-
 	return nil
 }
 
-func (s *Stratum) login() error {
-	msg := LoginParam{
-		Login: s.user,
-		Pass:  s.pass,
-		Agent: s.agent,
-		Rigid: s.rigid,
+func (s *Stratum) submit(result *JobResult) {
+	if atomic.LoadInt32(&s.draining) != 0 {
+		// the job is from the pool being left, its connection only waits for the answers it owes
+		loggo.Warn("Stratum drop share of the drained pool job=%v nonce=%v", result.job.id, result.nonce)
+		s.stat.addStale()
+		if result.done != nil {
+			result.done("stale job, pool switched")
+		}
+		return
 	}
+	s.stat.addSubmit()
 
-	loggo.Info("Stratum start login...")
+	err := s.getProto().submit(result)
+	if err != nil {
+		s.stat.addResult(err.Error())
+		loggo.Error("Stratum submit fail %v", err)
+		if result.done != nil {
+			result.done(err.Error())
+		}
+		return
+	}
+}
 
-	return s.send(1, "login", &msg)
+// call sends a request with a fresh id and keeps it pending until the pool answers or it times out
+func (s *Stratum) call(method string, p interface{}, timeout time.Duration, result *JobResult) error {
+	req := s.request(method, timeout, result)
+	err := s.send(req.id, method, p)
+	if err != nil {
+		s.answer(req.id)
+	}
+	return err
 }
 
-func (s *Stratum) submit(result *JobResult) {
+// callV1 is call for the bitcoin style request
+func (s *Stratum) callV1(method string, p interface{}, timeout time.Duration, result *JobResult) error {
+	req := s.request(method, timeout, result)
+	err := s.sendV1(req.id, method, p)
+	if err != nil {
+		s.answer(req.id)
+	}
+	return err
+}
 
-	atomic.AddUint32(&s.stat.submitJob, 1)
+func (s *Stratum) request(method string, timeout time.Duration, result *JobResult) *StratumRequest {
+	req := &StratumRequest{
+		id:      int(atomic.AddInt64(&s.ids, 1)),
+		method:  method,
+		sent:    time.Now(),
+		timeout: timeout,
+		result:  result,
+	}
+	if result != nil {
+		result.submit = req.sent
+	}
+	s.rlock.Lock()
+	s.pending[req.id] = req
+	s.rlock.Unlock()
+	return req
+}
 
-	var nonce_bytes [4]byte
-	binary.LittleEndian.PutUint32(nonce_bytes[:], result.nonce)
-	b, nonce_str := toHex(nonce_bytes[:])
-	if !b {
-		atomic.AddUint32(&s.stat.submitJobFail, 1)
-		loggo.Error("Stratum submit toHex nonce fail %v %v", result.nonce, nonce_str)
-		return
+// answer takes a request off the pending table, nil when it was never sent or already timed out
+func (s *Stratum) answer(id int) *StratumRequest {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+	req, ok := s.pending[id]
+	if !ok {
+		return nil
 	}
+	delete(s.pending, id)
+	return req
+}
 
-	b, hash_str := toHex(result.hash[:])
-	if !b {
-		atomic.AddUint32(&s.stat.submitJobFail, 1)
-		loggo.Error("Stratum submit toHex hash fail %v %v", result.hash, hash_str)
-		return
-	}
+func (s *Stratum) isPending(id int) bool {
+	s.rlock.Lock()
+	defer s.rlock.Unlock()
+	_, ok := s.pending[id]
+	return ok
+}
 
-	algo := ""
-	if s.ext_algo && result.job.algorithm != nil {
-		algo = result.job.algorithm.shortName()
+// expire fails the requests the pool left unanswered for too long, a lost submit counts as invalid
+func (s *Stratum) expire(reason string, all bool) {
+	now := time.Now()
+	var expired []*StratumRequest
+	s.rlock.Lock()
+	for id, req := range s.pending {
+		if all || now.Sub(req.sent) > req.timeout {
+			expired = append(expired, req)
+			delete(s.pending, id)
+		}
 	}
+	s.rlock.Unlock()
 
-	msg := SubmitParam{
-		Id:     s.rpcid,
-		JobId:  result.job.id,
-		Nonce:  nonce_str,
-		Result: hash_str,
-		Algo:   algo,
+	for _, req := range expired {
+		if req.result == nil {
+			loggo.Warn("Stratum %v %v %v after %v", req.method, req.id, reason, now.Sub(req.sent))
+			continue
+		}
+		loggo.Error("Stratum Submit Job Fail %v %v %v after %v", reason, req.result.job.id, req.id, now.Sub(req.sent))
+		s.stat.addResult(reason)
+		if req.result.done != nil {
+			req.result.done(reason)
+		}
 	}
+}
 
-	loggo.Info("Stratum submit JobId=%v Result=%v Nonce=%v", msg.JobId, msg.Result, msg.Nonce)
-
-	result.submit = time.Now()
-	s.submits.Store(s.sequence, result)
+func (s *Stratum) hb() {
+	s.expire("timeout", false)
 
-	err := s.send(s.sequence, "submit", &msg)
-	if err != nil {
-		atomic.AddUint32(&s.stat.submitJobFail, 1)
-		loggo.Error("Stratum submit send fail %v", err)
+	if s.state() != STRATUM_CONNECTED {
 		return
 	}
+
+	s.getProto().keepalive()
+
+	s.probePrimary()
 }
 
-func (s *Stratum) hb() {
-	msg := HBParam{
-		Id: s.rpcid,
+func (s *Stratum) probePrimary() {
+	s.plock.Lock()
+	need := s.cur != 0 && !s.pinned && s.cfg.probe > 0 && time.Now().Sub(s.lastProbe) > s.cfg.probe
+	if need {
+		s.lastProbe = time.Now()
+	}
+	s.plock.Unlock()
+
+	if !need || !atomic.CompareAndSwapInt32(&s.probing, 0, 1) {
+		return
 	}
-	s.send(s.sequence, "keepalived", &msg)
+
+	go func() {
+		defer common.CrashLog()
+		defer atomic.StoreInt32(&s.probing, 0)
+
+		primary := s.poolList()[0]
+		conn, err := dialPool(s.cfg.proxy, primary.host, primary.tls, primary.tlsfp)
+		if err != nil {
+			loggo.Info("Stratum probe primary pool %v fail %v", primary, err)
+			return
+		}
+		conn.Close()
+
+		loggo.Warn("Stratum primary pool %v is back, switch to it", primary)
+		s.switchPool(0)
+		s.drain()
+	}()
 }
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		backoff    time.Duration
+		backoffMax time.Duration
+		attempt    int
+		want       time.Duration // the delay before jitter
+	}{
+		{time.Second, time.Minute, 0, time.Second},
+		{time.Second, time.Minute, 1, time.Second * 2},
+		{time.Second, time.Minute, 5, time.Second * 32},
+		{time.Second, time.Minute, 6, time.Minute},
+		{time.Second, time.Minute, 1000, time.Minute},
+		// "retry-pause": 5 shifted by 31 used to overflow into a negative delay
+		{time.Second * 5, time.Minute, 31, time.Minute},
+		{time.Second * 5, time.Minute, 63, time.Minute},
+		{time.Second * 5, time.Duration(1<<63 - 1), 100, time.Duration(1<<63 - 1)},
+		{time.Second * 5, time.Second * 5, 3, time.Second * 5},
+	}
+	for _, tt := range tests {
+		s := &Stratum{cfg: StratumConfig{backoff: tt.backoff, backoffMax: tt.backoffMax}}
+		for i := 0; i < 20; i++ {
+			got := s.backoffDelay(tt.attempt)
+			if got < tt.want/2 || got > tt.want {
+				t.Errorf("backoffDelay(%v) with backoff %v max %v = %v, want in [%v, %v]",
+					tt.attempt, tt.backoff, tt.backoffMax, got, tt.want/2, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestStratumSubmitWhileReconnecting(t *testing.T) {
+	p, err := NewStubPool("127.0.0.1:0", "cn/0", "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	pool, err := NewPool(p.server.listener.Addr().String(), "cn/0", "rig", "x", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := make(chan *Job, 1024)
+	stat := &Stat{}
+	s, err := NewStratum([]*Pool{pool}, StratumConfig{backoff: time.Millisecond}, jobs, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.stop(time.Now().Add(time.Second))
+	j := nextJob(t, jobs)
+
+	// the connection drops every few milliseconds, listen replaces the protocol each time
+	stop := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond * 5):
+				s.closeConn()
+			}
+		}
+	}()
+
+	answered := make(chan string, 1024)
+	n := 0
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); n++ {
+		r := &JobResult{job: j, nonce: uint32(n)}
+		r.done = func(err string) {
+			answered <- err
+		}
+		s.submit(r)
+		s.hb()
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	<-closed
+
+	// every share is answered once, by the pool, a lost connection or a submit before login
+	for i := 0; i < n; i++ {
+		select {
+		case <-answered:
+		case <-time.After(kStratumRequestTimeout):
+			t.Fatalf("%v of %v shares answered", i, n)
+		}
+	}
+	if snap := stat.snapshot(); snap.reconnects == 0 {
+		t.Errorf("no reconnect while closing the connection")
+	}
+}
+
+func TestStratumRequestIds(t *testing.T) {
+	s := &Stratum{pending: make(map[int]*StratumRequest), stat: &Stat{}}
+
+	const n = 8
+	const each = 500
+	ids := make(chan int, n*each)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := 0; k < each; k++ {
+				ids <- s.request("submit", time.Minute, nil).id
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("id %v given twice", id)
+		}
+		seen[id] = true
+		if !s.isPending(id) {
+			t.Fatalf("id %v not pending", id)
+		}
+	}
+	if len(seen) != n*each || len(s.pending) != n*each {
+		t.Errorf("%v ids, %v pending, want %v", len(seen), len(s.pending), n*each)
+	}
+}
+
+func TestStratumExpire(t *testing.T) {
+	s := &Stratum{pending: make(map[int]*StratumRequest), stat: &Stat{}}
+
+	var answers []string
+	result := &JobResult{job: &Job{id: "j"}, done: func(err string) { answers = append(answers, err) }}
+	late := s.request("submit", 0, result)
+	waiting := s.request("submit", time.Minute, &JobResult{job: &Job{id: "j"}})
+	keepalive := s.request("keepalived", 0, nil)
+	time.Sleep(time.Millisecond)
+
+	s.expire("timeout", false)
+	if s.isPending(late.id) || s.isPending(keepalive.id) || !s.isPending(waiting.id) {
+		t.Fatalf("pending after expire %v/%v/%v", s.isPending(late.id), s.isPending(keepalive.id), s.isPending(waiting.id))
+	}
+	if snap := s.stat.snapshot(); snap.invalid != 1 || snap.accepted != 0 {
+		t.Errorf("expired submit counted invalid=%v accepted=%v, want 1 0", snap.invalid, snap.accepted)
+	}
+	if len(answers) != 1 || answers[0] != "timeout" {
+		t.Errorf("done called with %v", answers)
+	}
+
+	// the answer after the timeout is ignored, the share was already counted
+	if req := s.answer(late.id); req != nil {
+		t.Fatal("expired request still answered")
+	}
+	if !s.handleAnswer(late.id, nil, "") {
+		t.Error("late answer dropped the connection")
+	}
+	if snap := s.stat.snapshot(); snap.invalid != 1 || snap.accepted != 0 || len(answers) != 1 {
+		t.Errorf("late answer counted invalid=%v accepted=%v done=%v", snap.invalid, snap.accepted, answers)
+	}
+
+	// a lost connection fails everything still pending
+	s.expire("connection lost", true)
+	if s.isPending(waiting.id) {
+		t.Error("pending after the connection was lost")
+	}
+	if snap := s.stat.snapshot(); snap.invalid != 2 || snap.accepted != 0 {
+		t.Errorf("connection lost counted invalid=%v accepted=%v, want 2 0", snap.invalid, snap.accepted)
+	}
+}
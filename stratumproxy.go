@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/esrrhs/gohome/common"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// index 0 is never handed out, so every downstream blob has a non zero nonce and miners detect nicehash by themselves
+	kProxyMaxClients = 255
+)
+
+type ProxyClient struct {
+	conn     *ServerConn
+	index    byte
+	accepted uint64
+	rejected uint64
+}
+
+// Proxy holds one upstream Stratum session and splits its jobs across downstream miners, nicehash style
+type Proxy struct {
+	ctx             context.Context
+	cancel          context.CancelFunc
+	upstreamStopped bool // Run gave up because the upstream stopped, not because of Stop
+
+	upstream *Stratum
+	server   *StratumServer
+	jobs     chan *Job
+
+	lock    sync.Mutex
+	job     *Job
+	prev    *Job
+	clients map[string]*ProxyClient
+	used    [kProxyMaxClients + 1]bool
+	owner   byte // index of the only client served while the upstream job is nicehash, 0 none
+
+	stat *Stat
+}
+
+func NewProxy(pools []*Pool, cfg StratumConfig, listen string) (*Proxy, error) {
+	err := checkProxyPools(pools)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.jobs = make(chan *Job, 16)
+	p.clients = make(map[string]*ProxyClient)
+	p.stat = &Stat{}
+
+	s, err := NewStratum(pools, cfg, p.jobs, p.stat)
+	if err != nil {
+		return nil, err
+	}
+	p.upstream = s
+
+	go func() {
+		defer common.CrashLog()
+		p.dispatch()
+	}()
+
+	server, err := NewStratumServer(listen, p, true)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+
+	return p, nil
+}
+
+func checkProxyPools(pools []*Pool) error {
+	for _, pool := range pools {
+		if pool.daemon {
+			return errors.New("proxy can not use daemon pool " + pool.url)
+		}
+		if pool.proto != "" && pool.proto != PROTO_STRATUM {
+			return errors.New("proxy only supports stratum protocol " + pool.url)
+		}
+	}
+	return nil
+}
+
+// setPools hands a reloaded pool list to the upstream, downstream miners stay connected
+func (p *Proxy) setPools(pools []*Pool) error {
+	err := checkProxyPools(pools)
+	if err != nil {
+		return err
+	}
+	return p.upstream.setPools(pools)
+}
+
+func (p *Proxy) Stop() {
+	p.cancel()
+}
+
+// failure is why Run gave up on the upstream, nil when it was stopped
+func (p *Proxy) failure() error {
+	if !p.upstreamStopped {
+		return nil
+	}
+	if err := p.upstream.lastError(); err != nil {
+		return err
+	}
+	return errors.New("upstream pool stopped")
+}
+
+func (p *Proxy) Run() {
+	start := time.Now()
+	for p.ctx.Err() == nil {
+		if p.upstream.state() == STRATUM_STOPPED {
+			loggo.Error("Proxy upstream stopped, exiting")
+			p.upstreamStopped = true
+			break
+		}
+		if time.Now().Sub(start) > time.Minute {
+			start = time.Now()
+			p.lock.Lock()
+			for _, c := range p.clients {
+				loggo.Info("Proxy client %v index=%v accepted=%v rejected=%v", c.conn, c.index,
+					atomic.LoadUint64(&c.accepted), atomic.LoadUint64(&c.rejected))
+			}
+			clients := len(p.clients)
+			p.lock.Unlock()
+			snap := p.stat.snapshot()
+			loggo.Info("Proxy Clients=%v, Job=%v, JobSubmit=%v, JobAccept=%v, JobStale=%v, JobInvalid=%v, Pool=%v, State=%v", clients, snap.jobs,
+				snap.submitted, snap.accepted, snap.stale, snap.invalid, p.upstream.current(), p.upstream.stateName())
+		}
+		p.upstream.hb()
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	p.shutdown()
+}
+
+// shutdown stops taking downstream miners and relays the upstream answers to the submits in flight before closing
+func (p *Proxy) shutdown() {
+	loggo.Warn("Proxy stopping...")
+	p.cancel()
+	p.server.Close()
+	p.upstream.stop(time.Now().Add(kMinerStopTimeout))
+
+	snap := p.stat.snapshot()
+	loggo.Info("Proxy session Job=%v, JobSubmit=%v, JobAccept=%v, JobStale=%v, JobInvalid=%v, Reconnects=%v",
+		snap.jobs, snap.submitted, snap.accepted, snap.stale, snap.invalid, snap.reconnects)
+}
+
+func (p *Proxy) dispatch() {
+	for {
+		var j *Job
+		select {
+		case <-p.ctx.Done():
+			return
+		case j = <-p.jobs:
+		}
+		if j == nil {
+			loggo.Warn("Proxy upstream disconnected, downstream keeps the last job")
+			continue
+		}
+
+		p.lock.Lock()
+		p.prev = p.job
+		p.job = j
+		if !j.nicehash {
+			p.owner = 0
+		} else if p.owner == 0 {
+			// the owner keeps the nonce space over job changes, the clients closed before may not be gone yet
+			p.owner = p.firstClient()
+		}
+		for _, c := range p.clients {
+			if p.owner != 0 && c.index != p.owner {
+				// the pool left us one nonce byte only, two miners would find the same shares
+				loggo.Warn("Proxy upstream job %v is nicehash, close %v, only index %v is served", j.id, c.conn, p.owner)
+				c.conn.close()
+				continue
+			}
+			c.conn.sendJob(p.clientJob(c))
+		}
+		clients := len(p.clients)
+		p.lock.Unlock()
+
+		loggo.Info("Proxy new job id=%v algo=%v height=%v diff=%v clients=%v", j.id, j.algorithm.name(), j.height, j.diff, clients)
+	}
+}
+
+// firstClient is the lowest index in use, 0 when no client is connected
+func (p *Proxy) firstClient() byte {
+	for i := 1; i <= kProxyMaxClients; i++ {
+		if p.used[i] {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+// clientJob gives every downstream its own top nonce byte, the downstream miner then only rolls the low 24 bits,
+// a nicehash upstream job keeps the byte the pool set and goes to the owner only
+func (p *Proxy) clientJob(c *ProxyClient) *JobReplyData {
+	j := p.job
+	blob := j.blob
+	if !j.nicehash {
+		blob[j.nonceOffset()+3] = c.index
+	}
+	return toJobReplyData(j, blob[:])
+}
+
+func (p *Proxy) onLogin(conn *ServerConn, login *LoginParam) (*JobReplyData, *ErrorReply) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.job == nil {
+		return nil, &ErrorReply{Code: -1, Message: "No job from upstream yet"}
+	}
+	if p.job.nicehash && p.owner != 0 {
+		loggo.Error("Proxy upstream job is nicehash, reject %v", conn)
+		return nil, &ErrorReply{Code: -1, Message: "Proxy is full, the upstream job is nicehash"}
+	}
+
+	index := 0
+	for i := 1; i <= kProxyMaxClients; i++ {
+		if !p.used[i] {
+			index = i
+			break
+		}
+	}
+	if index == 0 {
+		loggo.Error("Proxy too many clients, reject %v", conn)
+		return nil, &ErrorReply{Code: -1, Message: "Proxy is full"}
+	}
+
+	c := &ProxyClient{
+		conn:  conn,
+		index: byte(index),
+	}
+	p.used[index] = true
+	p.clients[conn.id] = c
+	conn.data = c
+	if p.job.nicehash {
+		p.owner = c.index
+	}
+
+	loggo.Info("Proxy login %v index=%v agent=%v", conn, index, login.Agent)
+
+	return p.clientJob(c), nil
+}
+
+func (p *Proxy) onClose(conn *ServerConn) {
+	c, ok := conn.data.(*ProxyClient)
+	if !ok {
+		return
+	}
+
+	p.lock.Lock()
+	delete(p.clients, conn.id)
+	p.used[c.index] = false
+	if p.owner == c.index {
+		p.owner = 0
+	}
+	p.lock.Unlock()
+
+	loggo.Info("Proxy logout %v accepted=%v rejected=%v", conn, atomic.LoadUint64(&c.accepted), atomic.LoadUint64(&c.rejected))
+}
+
+func (p *Proxy) onSubmit(conn *ServerConn, id int, submit *SubmitParam) {
+	c := conn.data.(*ProxyClient)
+
+	reject := func(msg string) {
+		atomic.AddUint64(&c.rejected, 1)
+		loggo.Info("Proxy reject share %v job=%v nonce=%v %v", conn, submit.JobId, submit.Nonce, msg)
+		conn.reply(id, nil, &ErrorReply{Code: -1, Message: msg})
+	}
+
+	p.lock.Lock()
+	var job *Job
+	if p.job != nil && p.job.id == submit.JobId {
+		job = p.job
+	} else if p.prev != nil && p.prev.id == submit.JobId {
+		job = p.prev
+	}
+	owner := p.owner
+	p.lock.Unlock()
+
+	if job == nil {
+		reject("Block expired")
+		return
+	}
+
+	ok, nonce := fromHex(submit.Nonce)
+	if !ok || len(nonce) != 4 {
+		reject("Invalid nonce")
+		return
+	}
+	n := binary.LittleEndian.Uint32(nonce)
+	index := c.index
+	if job.nicehash {
+		// the top byte is the one the pool gave us, and only the owner mines it
+		index = job.blob[job.nonceOffset()+3]
+	}
+	if byte(n>>24) != index || (job.nicehash && c.index != owner) {
+		reject("Nonce out of range")
+		return
+	}
+
+	result := &JobResult{
+		job:   job,
+		nonce: n,
+	}
+	if !fromHexWithBuffer(result.hash[:], submit.Result) || len(submit.Result) != len(result.hash)*2 {
+		reject("Invalid result")
+		return
+	}
+	if !job.checkHash(result.hash[:]) {
+		reject("Low difficulty share")
+		return
+	}
+
+	result.done = func(err string) {
+		if err != "" {
+			atomic.AddUint64(&c.rejected, 1)
+			conn.reply(id, nil, &ErrorReply{Code: -1, Message: err})
+			return
+		}
+		atomic.AddUint64(&c.accepted, 1)
+		conn.reply(id, &StatusReply{Status: "OK"}, nil)
+	}
+
+	p.upstream.submit(result)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/esrrhs/gohome/crypto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestProxy runs a proxy in front of a stub pool, jobsFile empty serves the test blob
+func newTestProxy(t *testing.T, jobsFile string) (*Proxy, *StubPool) {
+	up, err := NewStubPool("127.0.0.1:0", "cn/0", jobsFile, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(up.Stop)
+
+	pool, err := NewPool(up.server.listener.Addr().String(), "cn/0", "proxy", "x", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy([]*Pool{pool}, StratumConfig{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		p.server.Close()
+		p.upstream.stop(time.Now().Add(time.Second))
+		p.cancel()
+	})
+
+	// downstream logins are refused until the first upstream job is dispatched
+	for deadline := time.Now().Add(time.Second * 5); ; {
+		p.lock.Lock()
+		ready := p.job != nil
+		p.lock.Unlock()
+		if ready {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no upstream job")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return p, up
+}
+
+// newTestDownstream logs a miner in to the proxy
+func newTestDownstream(p *Proxy) (*Stratum, chan *Job, error) {
+	pool, err := NewPool(p.server.listener.Addr().String(), "cn/0", "rig", "x", false, "", "")
+	if err != nil {
+		return nil, nil, err
+	}
+	jobs := make(chan *Job, 16)
+	s, err := NewStratum([]*Pool{pool}, StratumConfig{}, jobs, &Stat{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, jobs, nil
+}
+
+func proxyClient(p *Proxy, index byte) *ProxyClient {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, c := range p.clients {
+		if c.index == index {
+			return c
+		}
+	}
+	return nil
+}
+
+func waitProxyFree(t *testing.T, p *Proxy, index byte) {
+	for deadline := time.Now().Add(time.Second * 5); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		p.lock.Lock()
+		used := p.used[index]
+		p.lock.Unlock()
+		if !used {
+			return
+		}
+	}
+	t.Fatalf("index %v still in use", index)
+}
+
+func TestProxyLoginIndex(t *testing.T) {
+	p, _ := newTestProxy(t, "")
+
+	var miners []*Stratum
+	for want := byte(1); want <= 3; want++ {
+		s, jobs, err := newTestDownstream(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		miners = append(miners, s)
+		j := nextJob(t, jobs)
+		if got := j.blob[j.nonceOffset()+3]; got != want {
+			t.Errorf("miner %v got nonce byte %v", want, got)
+		}
+		if !j.nicehash || j.nonceMask() != 0xFFFFFF {
+			t.Errorf("miner %v job not nicehash, mask %x", want, j.nonceMask())
+		}
+	}
+
+	// a freed index goes to the next miner, the lowest first
+	miners[1].stop(time.Now())
+	waitProxyFree(t, p, 2)
+	s, jobs, err := newTestDownstream(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := nextJob(t, jobs)
+	if got := j.blob[j.nonceOffset()+3]; got != 2 {
+		t.Errorf("miner after logout got nonce byte %v, want the freed 2", got)
+	}
+
+	for _, m := range append(miners, s) {
+		m.stop(time.Now())
+	}
+}
+
+func TestProxyShares(t *testing.T) {
+	p, up := newTestProxy(t, "")
+	cy := crypto.NewCrypto("")
+
+	s1, jobs1, err := newTestDownstream(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.stop(time.Now())
+	s2, jobs2, err := newTestDownstream(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.stop(time.Now())
+	j1 := nextJob(t, jobs1)
+	j2 := nextJob(t, jobs2)
+
+	if err := submitWait(t, s1, share(cy, j1, 1<<24|7)); err != "" {
+		t.Errorf("share of miner 1 rejected: %v", err)
+	}
+	if err := submitWait(t, s2, share(cy, j2, 2<<24|7)); err != "" {
+		t.Errorf("share of miner 2 with the same low nonce rejected: %v", err)
+	}
+	// miner 2 rolled into the nonce range of miner 1
+	if err := submitWait(t, s2, share(cy, j2, 1<<24|8)); err != "Nonce out of range" {
+		t.Errorf("nonce of another miner answered %q", err)
+	}
+	if err := submitWait(t, s1, share(cy, j1, 0<<24|9)); err != "Nonce out of range" {
+		t.Errorf("nonce of index 0 answered %q", err)
+	}
+	// the upstream answer is relayed
+	if err := submitWait(t, s1, share(cy, j1, 1<<24|7)); err != "Duplicate share" {
+		t.Errorf("duplicate share answered %q", err)
+	}
+
+	c1, c2 := proxyClient(p, 1), proxyClient(p, 2)
+	if c1 == nil || c2 == nil {
+		t.Fatal("proxy clients missing")
+	}
+	if a, r := atomic.LoadUint64(&c1.accepted), atomic.LoadUint64(&c1.rejected); a != 1 || r != 2 {
+		t.Errorf("miner 1 accepted %v rejected %v, want 1 2", a, r)
+	}
+	if a, r := atomic.LoadUint64(&c2.accepted), atomic.LoadUint64(&c2.rejected); a != 1 || r != 1 {
+		t.Errorf("miner 2 accepted %v rejected %v, want 1 1", a, r)
+	}
+	if a := atomic.LoadUint64(&up.accepted); a != 2 {
+		t.Errorf("upstream accepted %v, want 2", a)
+	}
+
+	// after two upstream jobs the first one is unknown
+	up.rotate()
+	nextJob(t, jobs1)
+	up.rotate()
+	nextJob(t, jobs1)
+	if err := submitWait(t, s1, share(cy, j1, 1<<24|10)); err != "Block expired" {
+		t.Errorf("share of a gone job answered %q", err)
+	}
+}
+
+func TestProxyNicehashUpstream(t *testing.T) {
+	// the pool already set the top nonce byte, there is no byte left to split
+	blob := TEST_BLOB[:84] + "2a" + TEST_BLOB[86:]
+	data, _ := json.Marshal([]*JobReplyData{{Blob: blob, Target: TEST_TARGET, Height: TEST_HEIGHT}})
+	file := filepath.Join(t.TempDir(), "jobs.json")
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := newTestProxy(t, file)
+	cy := crypto.NewCrypto("")
+
+	s1, jobs1, err := newTestDownstream(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := nextJob(t, jobs1)
+	if got := j.blob[j.nonceOffset()+3]; got != 0x2a {
+		t.Errorf("owner got nonce byte %x, want the pool's 2a", got)
+	}
+
+	if s, _, err := newTestDownstream(p); err == nil {
+		s.stop(time.Now())
+		t.Error("second miner served a nicehash upstream job")
+	} else if !strings.Contains(err.Error(), "nicehash") {
+		t.Errorf("second miner refused with %v", err)
+	}
+
+	if err := submitWait(t, s1, share(cy, j, 0x2a<<24|1)); err != "" {
+		t.Errorf("share of the owner rejected: %v", err)
+	}
+	if err := submitWait(t, s1, share(cy, j, 1<<24|1)); err != "Nonce out of range" {
+		t.Errorf("nonce outside the pool's byte answered %q", err)
+	}
+
+	// the nonce space is free again once the owner leaves
+	s1.stop(time.Now())
+	waitProxyFree(t, p, 1)
+	s2, jobs2, err := newTestDownstream(p)
+	if err != nil {
+		t.Fatalf("miner after the owner left refused: %v", err)
+	}
+	defer s2.stop(time.Now())
+	nextJob(t, jobs2)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"math"
+)
+
+const (
+	kHeaderNonceOffset = 76
+	kHeaderSize        = 80
+)
+
+type Stratum1Protocol struct {
+	pool        *Pool // the pool logged in to
+	s           *Stratum
+	extraNonce1 []byte
+	extraSize   int
+	extraNonce2 uint64
+	diff        float64
+}
+
+func NewStratum1Protocol(pool *Pool, s *Stratum) *Stratum1Protocol {
+	return &Stratum1Protocol{pool: pool, s: s, diff: 1}
+}
+
+func (v *Stratum1Protocol) login() error {
+	loggo.Info("Stratum1 start subscribe...")
+
+	params := []string{}
+	if v.s.agent != "" {
+		params = append(params, v.s.agent)
+	}
+	err := v.s.callV1("mining.subscribe", params, kStratumLoginTimeout, nil)
+	if err != nil {
+		return err
+	}
+
+	pool := v.pool
+	return v.s.callV1("mining.authorize", []string{pool.user, pool.pass}, kStratumLoginTimeout, nil)
+}
+
+func (v *Stratum1Protocol) handle(line []byte) bool {
+	var rsp JSONRpcRspV1
+	err := json.Unmarshal(line, &rsp)
+	if err != nil {
+		loggo.Error("Stratum1 Unmarshal fail %v %v", string(line), err)
+		return false
+	}
+
+	if rsp.Method != "" {
+		return v.handleNotify(&rsp)
+	}
+
+	if rsp.Id == nil {
+		loggo.Error("Stratum1 handle no id")
+		return false
+	}
+
+	errmsg := v1Error(rsp.Error)
+
+	req := v.s.answer(*rsp.Id)
+	method := ""
+	if req != nil {
+		method = req.method
+	}
+
+	switch method {
+	case "mining.subscribe":
+		if errmsg != "" {
+			loggo.Error("Stratum1 subscribe fail %v", errmsg)
+			v.s.loginFail(&LoginError{Pool: v.pool.url, Message: errmsg})
+			return false
+		}
+		if !v.handleSubscribe(rsp.Result) {
+			loggo.Error("Stratum1 subscribe fail, bad reply")
+			v.s.loginFail(&ProtocolError{Pool: v.pool.url, Err: errors.New("bad subscribe reply")})
+			return false
+		}
+		return true
+	case "mining.authorize":
+		var ok bool
+		json.Unmarshal(rsp.Result, &ok)
+		if errmsg != "" || !ok {
+			loggo.Error("Stratum1 authorize fail %v", errmsg)
+			if errmsg == "" {
+				errmsg = "authorize refused"
+			}
+			v.s.loginFail(&LoginError{Pool: v.pool.url, Message: errmsg})
+			return false
+		}
+		v.s.loginOk()
+		loggo.Info("Stratum1 authorize ok")
+		return true
+	}
+
+	if errmsg == "" {
+		var ok bool
+		json.Unmarshal(rsp.Result, &ok)
+		if !ok {
+			errmsg = "rejected"
+		}
+	}
+	return v.s.handleAnswer(*rsp.Id, req, errmsg)
+}
+
+// v1Error reads the [code, message, traceback] error array, some pools send a plain object or string instead
+func v1Error(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var arr []interface{}
+	if json.Unmarshal(raw, &arr) == nil && len(arr) >= 2 {
+		return fmt.Sprint(arr[1])
+	}
+	var obj ErrorReply
+	if json.Unmarshal(raw, &obj) == nil && obj.Message != "" {
+		return obj.Message
+	}
+	return string(raw)
+}
+
+func (v *Stratum1Protocol) handleSubscribe(result json.RawMessage) bool {
+	var arr []json.RawMessage
+	err := json.Unmarshal(result, &arr)
+	if err != nil || len(arr) < 3 {
+		loggo.Error("Stratum1 handleSubscribe bad result %v", string(result))
+		return false
+	}
+
+	var en1 string
+	var size int
+	if json.Unmarshal(arr[1], &en1) != nil || json.Unmarshal(arr[2], &size) != nil {
+		loggo.Error("Stratum1 handleSubscribe bad extranonce %v", string(result))
+		return false
+	}
+	return v.setExtraNonce(en1, size)
+}
+
+func (v *Stratum1Protocol) setExtraNonce(en1 string, size int) bool {
+	ok, raw := fromHex(en1)
+	if !ok || size <= 0 || size > 8 {
+		loggo.Error("Stratum1 bad extranonce %v %v", en1, size)
+		return false
+	}
+	v.extraNonce1 = raw
+	v.extraSize = size
+	v.extraNonce2 = 0
+	loggo.Info("Stratum1 extranonce1=%v extranonce2_size=%v", en1, size)
+	return true
+}
+
+func (v *Stratum1Protocol) handleNotify(rsp *JSONRpcRspV1) bool {
+	loggo.Debug("Stratum1 handleNotify %v", rsp.Method)
+
+	switch rsp.Method {
+	case "mining.set_difficulty":
+		var params []float64
+		if json.Unmarshal(rsp.Params, &params) != nil || len(params) < 1 || params[0] <= 0 {
+			loggo.Error("Stratum1 bad difficulty %v", string(rsp.Params))
+			return false
+		}
+		v.diff = params[0]
+		loggo.Info("Stratum1 set difficulty %v", v.diff)
+		return true
+	case "mining.set_extranonce":
+		var params []json.RawMessage
+		var en1 string
+		var size int
+		if json.Unmarshal(rsp.Params, &params) != nil || len(params) < 2 ||
+			json.Unmarshal(params[0], &en1) != nil || json.Unmarshal(params[1], &size) != nil {
+			loggo.Error("Stratum1 bad extranonce %v", string(rsp.Params))
+			return false
+		}
+		return v.setExtraNonce(en1, size)
+	case "mining.notify":
+		return v.handleNotifyJob(rsp.Params)
+	}
+
+	loggo.Info("Stratum1 handleNotify unknow %v", rsp.Method)
+	return true
+}
+
+// handleNotifyJob builds the 80 byte block header, every job gets its own extranonce2 so workers restart the nonce from zero
+func (v *Stratum1Protocol) handleNotifyJob(params json.RawMessage) bool {
+	var p []json.RawMessage
+	if json.Unmarshal(params, &p) != nil || len(p) < 8 {
+		loggo.Error("Stratum1 handleNotifyJob bad params %v", string(params))
+		return false
+	}
+
+	var jobId, prevHash, coinb1, coinb2, version, nbits, ntime string
+	var branches []string
+	for i, dst := range []interface{}{&jobId, &prevHash, &coinb1, &coinb2, &branches, &version, &nbits, &ntime} {
+		if json.Unmarshal(p[i], dst) != nil {
+			loggo.Error("Stratum1 handleNotifyJob bad param %v %v", i, string(p[i]))
+			return false
+		}
+	}
+
+	if v.extraNonce1 == nil {
+		loggo.Error("Stratum1 handleNotifyJob not subscribed")
+		return false
+	}
+
+	algo := v.pool.algo
+	if algo == nil {
+		loggo.Error("Stratum1 no default Algorithm")
+		return false
+	}
+
+	var en2 [8]byte
+	binary.BigEndian.PutUint64(en2[:], v.extraNonce2)
+	v.extraNonce2++
+	extraNonce2 := en2[8-v.extraSize:]
+
+	ok1, cb1 := fromHex(coinb1)
+	ok2, cb2 := fromHex(coinb2)
+	if !ok1 || !ok2 {
+		loggo.Error("Stratum1 handleNotifyJob bad coinbase %v %v", coinb1, coinb2)
+		return false
+	}
+	coinbase := append(append(append(append([]byte{}, cb1...), v.extraNonce1...), extraNonce2...), cb2...)
+	root := sha256d(coinbase)
+	for _, b := range branches {
+		ok, branch := fromHex(b)
+		if !ok || len(branch) != 32 {
+			loggo.Error("Stratum1 handleNotifyJob bad merkle branch %v", b)
+			return false
+		}
+		root = sha256d(append(root, branch...))
+	}
+
+	okv, ver := fromHex(version)
+	okp, prev := fromHex(prevHash)
+	okb, bits := fromHex(nbits)
+	okt, tm := fromHex(ntime)
+	if !okv || !okp || !okb || !okt || len(ver) != 4 || len(prev) != 32 || len(bits) != 4 || len(tm) != 4 {
+		loggo.Error("Stratum1 handleNotifyJob bad header fields %v %v %v %v", version, prevHash, nbits, ntime)
+		return false
+	}
+
+	header := make([]byte, 0, kHeaderSize)
+	header = append(header, reverseBytes(ver)...)
+	for i := 0; i < 32; i += 4 {
+		header = append(header, reverseBytes(prev[i:i+4])...)
+	}
+	header = append(header, root...)
+	header = append(header, reverseBytes(tm)...)
+	header = append(header, reverseBytes(bits)...)
+	header = append(header, 0, 0, 0, 0)
+
+	j := &Job{
+		algorithm: algo,
+		id:        jobId,
+		nonceOff:  kHeaderNonceOffset,
+		ntime:     ntime,
+	}
+	j.extraNonce2 = hex.EncodeToString(extraNonce2)
+
+	if !j.setBlob(hex.EncodeToString(header)) {
+		loggo.Error("Stratum1 handleNotifyJob fail header %x", header)
+		return false
+	}
+
+	j.target = diffToTarget(v.diff)
+	j.diff = v.diff
+
+	v.s.newJob(j)
+
+	return true
+}
+
+func (v *Stratum1Protocol) submit(result *JobResult) error {
+	if result.job.nonceOff != kHeaderNonceOffset {
+		return errors.New("job " + result.job.id + " not from stratum1")
+	}
+
+	nonce := fmt.Sprintf("%08x", result.nonce)
+	pool := v.pool
+	params := []string{pool.user, result.job.id, result.job.extraNonce2, result.job.ntime, nonce}
+
+	loggo.Info("Stratum1 submit JobId=%v ExtraNonce2=%v Nonce=%v", result.job.id, result.job.extraNonce2, nonce)
+
+	return v.s.callV1("mining.submit", params, kStratumSubmitTimeout, result)
+}
+
+func (v *Stratum1Protocol) keepalive() {
+}
+
+// diffToTarget uses the bitcoin difficulty 1 target 0x00000000ffff0000..., compared against the top 64 bits of the hash
+func diffToTarget(diff float64) uint64 {
+	t := float64(0xFFFF0000) / diff
+	if t >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(t)
+}
+
+func sha256d(data []byte) []byte {
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[i] = b[len(b)-1-i]
+	}
+	return r
+}
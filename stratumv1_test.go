@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDiffToTarget(t *testing.T) {
+	tests := []struct {
+		diff float64
+		want uint64
+	}{
+		{1, 0xFFFF0000},
+		{2, 0x7FFF8000},
+		{0.5, 0x1FFFE0000},
+		{65536, 0xFFFF},
+		{0xFFFF0000, 1},
+		{1e-20, math.MaxUint64},
+		{0, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		if got := diffToTarget(tt.diff); got != tt.want {
+			t.Errorf("diffToTarget(%v) = %x, want %x", tt.diff, got, tt.want)
+		}
+	}
+}
+
+// bitcoin block 1, its coinbase is split around extranonce1 f2052a01 and a 3 byte extranonce2 of zeros
+const (
+	testV1Header   = "010000006fe28c0ab6f1b372c1a6a246ae63f74f931e8365e15a089c68d6190000000000982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e61bc6649ffff001d01e36299"
+	testV1Hash     = "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048"
+	testV1PrevHash = "0a8ce26f72b3f1b646a2a6c14ff763ae65831e939c085ae10019d66800000000"
+	testV1Coinb1   = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff0704ffff001d0104ffffffff0100"
+	testV1Coinb2   = "43410496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858eeac00000000"
+	testV1Nonce    = 0x9962e301
+)
+
+// newTestStratum1 is a subscribed stratum v1 session without a pool, what it sends is read from the returned conn
+func newTestStratum1(t *testing.T) (*Stratum1Protocol, *Stratum, chan *Job, net.Conn) {
+	pool, err := NewPool("127.0.0.1:3333", "cn/0", "rig", "x", false, "", PROTO_STRATUM1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	jobs := make(chan *Job, 16)
+	s := &Stratum{pools: []*Pool{pool}, conn: local, jobs: jobs, stat: &Stat{}, pending: make(map[int]*StratumRequest)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	v := NewStratum1Protocol(pool, s)
+	if !v.handle([]byte(`{"id":null,"method":"mining.set_extranonce","params":["f2052a01",3]}`)) {
+		t.Fatal("set_extranonce refused")
+	}
+	return v, s, jobs, remote
+}
+
+func notifyV1(t *testing.T, v *Stratum1Protocol, jobs chan *Job, branches []string) *Job {
+	params, _ := json.Marshal([]interface{}{"b1", testV1PrevHash, testV1Coinb1, testV1Coinb2, branches, "00000001", "1d00ffff", "4966bc61", true})
+	if !v.handle([]byte(`{"id":null,"method":"mining.notify","params":` + string(params) + `}`)) {
+		t.Fatal("notify refused")
+	}
+	return nextJob(t, jobs)
+}
+
+func TestStratum1Header(t *testing.T) {
+	v, _, jobs, _ := newTestStratum1(t)
+	j := notifyV1(t, v, jobs, []string{})
+
+	want, _ := hex.DecodeString(testV1Header)
+	if j.size != kHeaderSize || j.nonceOffset() != 76 {
+		t.Fatalf("header size %v nonce offset %v", j.size, j.nonceOffset())
+	}
+	if got := j.blob[:76]; hex.EncodeToString(got) != hex.EncodeToString(want[:76]) {
+		t.Errorf("header\n got %x\nwant %x", got, want[:76])
+	}
+	if j.nonce() != 0 || j.extraNonce2 != "000000" || j.ntime != "4966bc61" {
+		t.Errorf("nonce %x extranonce2 %v ntime %v", j.nonce(), j.extraNonce2, j.ntime)
+	}
+
+	// with the nonce the pool found the header hashes to the block
+	header := j.blob
+	copy(header[76:], want[76:])
+	if got := hex.EncodeToString(reverseBytes(sha256d(header[:kHeaderSize]))); got != testV1Hash {
+		t.Errorf("block hash %v, want %v", got, testV1Hash)
+	}
+
+	// the next job of the same notify rolls extranonce2, so the merkle root differs
+	next := notifyV1(t, v, jobs, []string{})
+	if next.extraNonce2 != "000001" || next.work() == j.work() || string(next.blob[36:68]) == string(j.blob[36:68]) {
+		t.Errorf("next job extranonce2 %v root %x", next.extraNonce2, next.blob[36:68])
+	}
+
+	// a merkle branch is hashed in after the coinbase
+	branch := "982051fd1e4ba744bbbe680e1fee14677ba1a3c3540bf7b1cdb606e857233e0e"
+	b := notifyV1(t, v, jobs, []string{branch})
+	coinbase, _ := hex.DecodeString(testV1Coinb1 + "f2052a01" + b.extraNonce2 + testV1Coinb2)
+	raw, _ := hex.DecodeString(branch)
+	if root := sha256d(append(sha256d(coinbase), raw...)); string(b.blob[36:68]) != string(root) {
+		t.Errorf("root with branch %x, want %x", b.blob[36:68], root)
+	}
+}
+
+func TestStratum1Difficulty(t *testing.T) {
+	v, _, jobs, _ := newTestStratum1(t)
+	if !v.handle([]byte(`{"id":null,"method":"mining.set_difficulty","params":[0.5]}`)) {
+		t.Fatal("set_difficulty refused")
+	}
+	j := notifyV1(t, v, jobs, []string{})
+	if j.diff != 0.5 || j.target != diffToTarget(0.5) {
+		t.Errorf("diff %v target %x, want 0.5 %x", j.diff, j.target, diffToTarget(0.5))
+	}
+}
+
+func TestStratum1Submit(t *testing.T) {
+	v, s, jobs, remote := newTestStratum1(t)
+	j := notifyV1(t, v, jobs, []string{})
+
+	go v.submit(&JobResult{job: j, nonce: testV1Nonce})
+	remote.SetReadDeadline(time.Now().Add(time.Second * 5))
+	line, err := bufio.NewReader(remote).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Id     int      `json:"id"`
+		Method string   `json:"method"`
+		Params []string `json:"params"`
+	}
+	if err := json.Unmarshal([]byte(line), &req); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"rig", "b1", "000000", "4966bc61", "9962e301"}
+	if req.Method != "mining.submit" || len(req.Params) != len(want) {
+		t.Fatalf("sent %v", line)
+	}
+	for i := range want {
+		if req.Params[i] != want[i] {
+			t.Errorf("submit param %v = %v, want %v", i, req.Params[i], want[i])
+		}
+	}
+	if !s.isPending(req.Id) {
+		t.Errorf("submit %v not pending", req.Id)
+	}
+}
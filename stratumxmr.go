@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"sync"
+)
+
+type XmrProtocol struct {
+	pool  *Pool // the pool logged in to
+	s     *Stratum
+	lock  sync.Mutex // rpcid and ext_* are set by the login answer while the miner submits
+	rpcid string
+
+	ext_algo      bool
+	ext_nicehash  bool
+	ext_connect   bool
+	ext_keepalive bool
+}
+
+func NewXmrProtocol(pool *Pool, s *Stratum) *XmrProtocol {
+	return &XmrProtocol{pool: pool, s: s}
+}
+
+func (x *XmrProtocol) login() error {
+	pool := x.pool
+	msg := LoginParam{
+		Login: pool.user,
+		Pass:  pool.pass,
+		Agent: x.s.agent,
+		Rigid: pool.rigid,
+	}
+
+	loggo.Info("Stratum start login...")
+
+	return x.s.call("login", &msg, kStratumLoginTimeout, nil)
+}
+
+func (x *XmrProtocol) handle(line []byte) bool {
+	var rsp JSONRpcRsp
+	err := json.Unmarshal(line, &rsp)
+	if err != nil {
+		loggo.Error("Stratum Unmarshal fail %v %v", string(line), err)
+		return false
+	}
+	return x.handleRsp(rsp)
+}
+
+func (x *XmrProtocol) handleRsp(rsp JSONRpcRsp) bool {
+	loggo.Debug("Stratum handleRsp %v", rsp.Id)
+	err := rsp.Error
+	if rsp.Id == 0 && err == nil {
+		return x.handleNotify(rsp)
+	}
+
+	req := x.s.answer(rsp.Id)
+	if err != nil {
+		if req != nil && req.method == "login" {
+			loggo.Error("Stratum login error %v", err.Message)
+			x.s.loginFail(&LoginError{Pool: x.pool.url, Message: err.Message})
+			return false
+		}
+		x.s.handleAnswer(rsp.Id, req, err.Message)
+		loggo.Error("Stratum handleRsp error %v", err)
+		return false
+	}
+
+	return x.handleResponse(rsp.Id, req, rsp)
+}
+
+func (x *XmrProtocol) handleNotify(rsp JSONRpcRsp) bool {
+	loggo.Debug("Stratum handleNotify %v", rsp.Method)
+
+	if rsp.Method == "" {
+		loggo.Error("Stratum handleNotify no method")
+		return false
+	}
+
+	m := rsp.Method
+	if m == "job" {
+		return x.handleNotifyJob(rsp)
+	}
+
+	return true
+}
+
+func (x *XmrProtocol) handleNotifyJob(rsp JSONRpcRsp) bool {
+	loggo.Debug("Stratum handleNotifyJob %v", rsp.Method)
+
+	if rsp.Params == nil {
+		loggo.Error("Stratum handleNotifyJob no Params")
+		return false
+	}
+
+	var job JobReplyData
+	err := json.Unmarshal(*rsp.Params, &job)
+	if err != nil {
+		loggo.Error("Stratum handleNotifyJob Unmarshal fail %v", err)
+		return false
+	}
+
+	return x.parseJob(&job)
+}
+
+func (x *XmrProtocol) handleResponse(id int, req *StratumRequest, rsp JSONRpcRsp) bool {
+	loggo.Debug("Stratum handleResponse %v", id)
+	if req != nil && req.method == "login" {
+		if !x.handleLogin(rsp) {
+			x.s.loginFail(&ProtocolError{Pool: x.pool.url, Err: errors.New("bad login reply")})
+			return false
+		}
+		return true
+	}
+
+	return x.s.handleAnswer(id, req, "")
+}
+
+func (x *XmrProtocol) handleLogin(rsp JSONRpcRsp) bool {
+	result := rsp.Result
+	if result == nil {
+		loggo.Error("Stratum handleLogin no result")
+		return false
+	}
+
+	loggo.Debug("Stratum handleLogin rsp")
+
+	if result.Id == "" {
+		loggo.Error("Stratum handleLogin no Id")
+		return false
+	}
+
+	x.lock.Lock()
+	x.rpcid = result.Id
+	ok := x.parseExtensions(result)
+	x.lock.Unlock()
+	if !ok {
+		loggo.Error("Stratum parseExtensions fail")
+		return false
+	}
+
+	if !x.parseJob(result.Job) {
+		loggo.Error("Stratum parseJob fail")
+		return false
+	}
+
+	x.s.loginOk()
+
+	loggo.Info("Stratum handleLogin ok")
+
+	return true
+}
+
+func (x *XmrProtocol) parseJob(job *JobReplyData) bool {
+	j := &Job{
+		algorithm: x.pool.algo,
+		nicehash:  x.ext_nicehash,
+		clientId:  x.rpcid,
+	}
+
+	if job.JobId == "" {
+		loggo.Error("Stratum parseJob no JobId")
+		return false
+	}
+	j.id = job.JobId
+
+	if job.Algo != "" {
+		j.algorithm = NewAlgorithm(job.Algo)
+		if j.algorithm == nil {
+			loggo.Error("Stratum parseJob fail Algorithm %v", job.Algo)
+			return false
+		}
+	} else {
+		if j.algorithm == nil {
+			loggo.Error("Stratum no default Algorithm")
+			return false
+		}
+	}
+
+	if !j.setBlob(job.Blob) {
+		loggo.Error("Stratum parseJob fail Blob %v", job.Blob)
+		return false
+	}
+
+	if !j.setTarget(job.Target) {
+		loggo.Error("Stratum parseJob fail Target %v", job.Target)
+		return false
+	}
+
+	j.height = job.Height
+
+	if j.algorithm.family() == RANDOM_X {
+		if !j.setSeedHash(job.SeedHash) {
+			loggo.Error("Stratum parseJob fail SeedHash %v", job.SeedHash)
+			return false
+		}
+	}
+
+	x.s.newJob(j)
+
+	return true
+}
+
+func (x *XmrProtocol) parseExtensions(result *JobReply) bool {
+	for _, name := range result.Extensions {
+		if name == "algo" {
+			x.ext_algo = true
+		} else if name == "nicehash" {
+			x.ext_nicehash = true
+		} else if name == "connect" {
+			x.ext_connect = true
+		} else if name == "keepalive" {
+			x.ext_keepalive = true
+		} else {
+			loggo.Info("Stratum parseExtensions unknow %v", name)
+		}
+	}
+	return true
+}
+
+// session is what the login answer gave, an empty rpcid means not logged in yet
+func (x *XmrProtocol) session() (string, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	return x.rpcid, x.ext_algo
+}
+
+func (x *XmrProtocol) submit(result *JobResult) error {
+	rpcid, ext_algo := x.session()
+	if rpcid == "" {
+		return errors.New("not logged in")
+	}
+
+	var nonce_bytes [4]byte
+	binary.LittleEndian.PutUint32(nonce_bytes[:], result.nonce)
+	b, nonce_str := toHex(nonce_bytes[:])
+	if !b {
+		return errors.New("toHex nonce fail " + nonce_str)
+	}
+
+	b, hash_str := toHex(result.hash[:])
+	if !b {
+		return errors.New("toHex hash fail " + hash_str)
+	}
+
+	algo := ""
+	if ext_algo && result.job.algorithm != nil {
+		algo = result.job.algorithm.shortName()
+	}
+
+	msg := SubmitParam{
+		Id:     rpcid,
+		JobId:  result.job.id,
+		Nonce:  nonce_str,
+		Result: hash_str,
+		Algo:   algo,
+	}
+
+	loggo.Info("Stratum submit JobId=%v Result=%v Nonce=%v", msg.JobId, msg.Result, msg.Nonce)
+
+	return x.s.call("submit", &msg, kStratumSubmitTimeout, result)
+}
+
+func (x *XmrProtocol) keepalive() {
+	rpcid, _ := x.session()
+	msg := HBParam{
+		Id: rpcid,
+	}
+	x.s.call("keepalived", &msg, kStratumRequestTimeout, nil)
+}
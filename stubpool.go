@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/esrrhs/gohome/crypto"
+	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StubPool is a local pool serving scripted jobs, every submit is hashed again and answered accept or reject
+type StubPool struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	server  *StratumServer
+	scripts []*JobReplyData
+	diff    uint64
+	jobtime time.Duration
+
+	lock    sync.Mutex
+	cy      *crypto.Crypto
+	next    int
+	job     *Job
+	prev    *Job
+	seen    map[string]bool
+	clients map[string]*ServerConn
+
+	accepted uint64
+	rejected uint64
+}
+
+func NewStubPool(listen string, algo string, jobsFile string, diff uint64, jobtime time.Duration) (*StubPool, error) {
+	p := &StubPool{}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.diff = diff
+	p.jobtime = jobtime
+	p.cy = crypto.NewCrypto("")
+	p.seen = make(map[string]bool)
+	p.clients = make(map[string]*ServerConn)
+
+	if jobsFile != "" {
+		data, err := os.ReadFile(jobsFile)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &p.scripts)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad jobs file "+jobsFile)
+		}
+		if len(p.scripts) == 0 {
+			return nil, errors.New("no job in " + jobsFile)
+		}
+	} else {
+		p.scripts = []*JobReplyData{{
+			Blob:   TEST_BLOB,
+			Target: TEST_TARGET,
+			Height: TEST_HEIGHT,
+		}}
+	}
+
+	for i, script := range p.scripts {
+		if script.Algo == "" {
+			script.Algo = algo
+		}
+		j, err := p.parseJob(script, strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		err = checkAlgo(j.algorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.rotate()
+
+	server, err := NewStratumServer(listen, p, false)
+	if err != nil {
+		return nil, err
+	}
+	p.server = server
+
+	return p, nil
+}
+
+func (p *StubPool) parseJob(script *JobReplyData, id string) (*Job, error) {
+	j := &Job{
+		algorithm: NewAlgorithm(script.Algo),
+		id:        id,
+		height:    script.Height,
+	}
+	if j.algorithm.id == INVALID {
+		return nil, errors.New("stub pool job bad algo " + script.Algo)
+	}
+	if !j.setBlob(script.Blob) {
+		return nil, errors.New("stub pool job bad blob " + script.Blob)
+	}
+	if p.diff > 0 {
+		j.target = 0xFFFFFFFFFFFFFFFF / p.diff
+		j.diff = float64(p.diff)
+	} else if !j.setTarget(script.Target) {
+		return nil, errors.New("stub pool job bad target " + script.Target)
+	}
+	if script.SeedHash != "" && !j.setSeedHash(script.SeedHash) {
+		return nil, errors.New("stub pool job bad seed_hash " + script.SeedHash)
+	}
+	return j, nil
+}
+
+// rotate moves to the next scripted job, the job id changes every time so old shares turn stale
+func (p *StubPool) rotate() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	script := p.scripts[p.next%len(p.scripts)]
+	p.next++
+	j, _ := p.parseJob(script, strconv.Itoa(p.next))
+	p.prev = p.job
+	p.job = j
+	p.seen = make(map[string]bool)
+
+	for _, c := range p.clients {
+		c.sendJob(toJobReplyData(j, j.blob[:]))
+	}
+
+	loggo.Info("StubPool new job id=%v algo=%v height=%v diff=%v clients=%v", j.id, j.algorithm.name(), j.height, j.diff, len(p.clients))
+}
+
+func (p *StubPool) Stop() {
+	p.cancel()
+	p.server.Close()
+}
+
+func (p *StubPool) Run() {
+	start := time.Now()
+	last := time.Now()
+	for p.ctx.Err() == nil {
+		if p.jobtime > 0 && time.Now().Sub(last) > p.jobtime {
+			last = time.Now()
+			p.rotate()
+		}
+		if time.Now().Sub(start) > time.Minute {
+			start = time.Now()
+			p.lock.Lock()
+			clients := len(p.clients)
+			p.lock.Unlock()
+			loggo.Info("StubPool Clients=%v, Accepted=%v, Rejected=%v", clients, atomic.LoadUint64(&p.accepted), atomic.LoadUint64(&p.rejected))
+		}
+		select {
+		case <-p.ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (p *StubPool) onLogin(conn *ServerConn, login *LoginParam) (*JobReplyData, *ErrorReply) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.clients[conn.id] = conn
+
+	loggo.Info("StubPool login %v agent=%v", conn, login.Agent)
+
+	return toJobReplyData(p.job, p.job.blob[:]), nil
+}
+
+func (p *StubPool) onClose(conn *ServerConn) {
+	p.lock.Lock()
+	delete(p.clients, conn.id)
+	p.lock.Unlock()
+
+	loggo.Info("StubPool logout %v", conn)
+}
+
+func (p *StubPool) onSubmit(conn *ServerConn, id int, submit *SubmitParam) {
+	err := p.verify(submit)
+	if err != "" {
+		atomic.AddUint64(&p.rejected, 1)
+		loggo.Warn("StubPool reject share %v job=%v nonce=%v %v", conn, submit.JobId, submit.Nonce, err)
+		conn.reply(id, nil, &ErrorReply{Code: -1, Message: err})
+		return
+	}
+
+	atomic.AddUint64(&p.accepted, 1)
+	loggo.Info("StubPool accept share %v job=%v nonce=%v", conn, submit.JobId, submit.Nonce)
+	conn.reply(id, &StatusReply{Status: "OK"}, nil)
+}
+
+func (p *StubPool) verify(submit *SubmitParam) string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	j := p.job
+	if j.id != submit.JobId {
+		if p.prev != nil && p.prev.id == submit.JobId {
+			return "Block expired"
+		}
+		return "Invalid job id"
+	}
+
+	ok, nonce := fromHex(submit.Nonce)
+	if !ok || len(nonce) != 4 {
+		return "Invalid nonce"
+	}
+	if p.seen[submit.Nonce] {
+		return "Duplicate share"
+	}
+
+	blob := j.blob
+	copy(blob[j.nonceOffset():], nonce)
+	hash := p.cy.Sum(blob[:j.size], j.algorithm.supportAlgoName(), j.height)
+
+	_, result := toHex(hash)
+	if result != submit.Result {
+		return "Invalid result"
+	}
+	if !j.checkHash(hash) {
+		return "Low difficulty share"
+	}
+
+	p.seen[submit.Nonce] = true
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"github.com/esrrhs/gohome/crypto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestStubPool(t *testing.T) (*StubPool, *Stratum, chan *Job, *Stat) {
+	p, err := NewStubPool("127.0.0.1:0", "cn/0", "", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+
+	pool, err := NewPool(p.server.listener.Addr().String(), "cn/0", "rig", "x", false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs := make(chan *Job, 16)
+	stat := &Stat{}
+	s, err := NewStratum([]*Pool{pool}, StratumConfig{}, jobs, stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.stop(time.Now().Add(time.Second)) })
+	return p, s, jobs, stat
+}
+
+// share hashes the job with nonce like a worker does
+func share(cy *crypto.Crypto, j *Job, nonce uint32) *JobResult {
+	blob := j.blob
+	binary.LittleEndian.PutUint32(blob[j.nonceOffset():], nonce)
+	r := &JobResult{job: j, nonce: nonce}
+	copy(r.hash[:], cy.Sum(blob[:j.size], j.algorithm.supportAlgoName(), j.height))
+	return r
+}
+
+// submitWait submits r and returns the pool answer, empty means accepted
+func submitWait(t *testing.T, s *Stratum, r *JobResult) string {
+	answer := make(chan string, 1)
+	r.done = func(err string) {
+		answer <- err
+	}
+	s.submit(r)
+	select {
+	case err := <-answer:
+		return err
+	case <-time.After(time.Second * 5):
+		t.Fatal("no answer to submit")
+	}
+	return ""
+}
+
+func TestStubPoolShares(t *testing.T) {
+	p, s, jobs, stat := newTestStubPool(t)
+	cy := crypto.NewCrypto("")
+
+	j := nextJob(t, jobs)
+	if j.diff != 1 {
+		t.Errorf("job diff %v, want the -diff of the stub pool", j.diff)
+	}
+
+	if err := submitWait(t, s, share(cy, j, 1)); err != "" {
+		t.Fatalf("valid share rejected: %v", err)
+	}
+	if err := submitWait(t, s, share(cy, j, 1)); err != "Duplicate share" {
+		t.Errorf("same nonce again answered %q", err)
+	}
+	bad := share(cy, j, 2)
+	bad.hash[0] ^= 0xff
+	if err := submitWait(t, s, bad); err != "Invalid result" {
+		t.Errorf("wrong hash answered %q", err)
+	}
+
+	p.rotate()
+	next := nextJob(t, jobs)
+	if next.id == j.id {
+		t.Fatalf("rotate kept job %v", j.id)
+	}
+	if err := submitWait(t, s, share(cy, j, 3)); err != "Block expired" {
+		t.Errorf("share of the replaced job answered %q", err)
+	}
+	if err := submitWait(t, s, share(cy, next, 3)); err != "" {
+		t.Errorf("share of the new job rejected: %v", err)
+	}
+
+	snap := stat.snapshot()
+	if snap.submitted != 5 || snap.accepted != 2 || snap.stale != 1 || snap.invalid != 2 {
+		t.Errorf("submitted %v accepted %v stale %v invalid %v", snap.submitted, snap.accepted, snap.stale, snap.invalid)
+	}
+	if accepted, rejected := atomic.LoadUint64(&p.accepted), atomic.LoadUint64(&p.rejected); accepted != 2 || rejected != 3 {
+		t.Errorf("stub pool accepted %v rejected %v", accepted, rejected)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -17,13 +18,15 @@ const (
 )
 
 type Tester struct {
-	exit bool
-	algo *Algorithm
+	ctx    context.Context
+	cancel context.CancelFunc
+	algo   *Algorithm
 }
 
 func NewTester(alname string) (*Tester, error) {
 
 	t := &Tester{}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 
 	al := NewAlgorithm(alname)
 	if al.id == INVALID {
@@ -41,7 +44,7 @@ func NewTester(alname string) (*Tester, error) {
 }
 
 func (t *Tester) Stop() {
-	t.exit = true
+	t.cancel()
 }
 
 func (t *Tester) Run() {
@@ -65,7 +68,7 @@ func (t *Tester) Run() {
 
 	start := time.Now()
 
-	for !t.exit {
+	for t.ctx.Err() == nil {
 		job := wj.currentJob()
 		currentJobNonces := wj.nonce0()
 
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
 	"github.com/esrrhs/gohome/crypto"
 	"github.com/esrrhs/gohome/loggo"
+	"github.com/pkg/errors"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,58 +22,78 @@ type Worker struct {
 	lock   sync.Mutex
 	result chan *JobResult
 	stat   *Stat
+	hashes uint64 // never cleared, the miner turns it into per thread speed
+	cpu    int    // pinned cpu, -1 lets the scheduler move it
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func NewWorker(result chan *JobResult, stat *Stat) *Worker {
+func NewWorker(ctx context.Context, result chan *JobResult, stat *Stat, cpu int) *Worker {
 	w := &Worker{}
+	w.cpu = cpu
+	w.ctx, w.cancel = context.WithCancel(ctx)
 	w.result = result
 	w.stat = stat
 	return w
 }
 
 func (w *Worker) start() {
+	if w.cpu >= 0 {
+		// never unlocked, the pinned thread exits with the goroutine instead of going back to the scheduler
+		runtime.LockOSThread()
+		err := pinThread(w.cpu)
+		if err != nil {
+			loggo.Error("worker pin cpu %v fail %v", w.cpu, err)
+		} else {
+			loggo.Info("worker pinned to cpu %v", w.cpu)
+		}
+	}
 
 	cy := crypto.NewCrypto("")
 
-	for {
-		if w.wj == nil {
+	for w.ctx.Err() == nil {
+		w.lock.Lock()
+		wj := w.wj
+		w.lock.Unlock()
+
+		if wj == nil {
 			time.Sleep(time.Millisecond * 5)
 			continue
 		}
 
-		for w.wj.seq == gSequence {
-			job := w.wj.currentJob()
-			currentJobNonces := w.wj.nonce0()
+		for wj.seq == atomic.LoadUint64(&gSequence) && w.ctx.Err() == nil {
+			job := wj.currentJob()
+			currentJobNonces := wj.nonce0()
 
 			algo := job.algorithm.supportAlgoName()
-			hash := cy.Sum(w.wj.blob()[0:job.size], algo, job.height)
+			hash := cy.Sum(wj.blob()[0:job.size], algo, job.height)
 
-			if !w.nextRound() {
+			if !w.nextRound(wj) {
 				break
 			}
 
-			value := binary.LittleEndian.Uint64(hash[24:])
-			if value < job.target {
+			if job.checkHash(hash) {
 				w.submit(job, currentJobNonces, hash)
 			}
 
-			atomic.AddUint32(&w.stat.hash, 1)
+			atomic.AddUint64(&w.hashes, 1)
+			w.stat.addHash()
 		}
 
-		if w.wj.seq == gSequence {
+		if wj.seq == atomic.LoadUint64(&gSequence) {
 			w.lock.Lock()
-			if w.wj.seq == gSequence {
+			if w.wj == wj {
 				w.wj = nil
-				loggo.Debug("worker remove job %v", gSequence)
+				loggo.Debug("worker remove job %v", wj.seq)
 			}
 			w.lock.Unlock()
 		}
 	}
 }
 
-func (w *Worker) nextRound() bool {
-	if !w.wj.nextRound(kReserveCount, 1) {
-		w.done(w.wj.currentJob())
+func (w *Worker) nextRound(wj *WorkerJob) bool {
+	if !wj.nextRound(kReserveCount, 1) {
+		w.done(wj.currentJob())
 		return false
 	}
 	return true
@@ -97,3 +121,38 @@ func (w *Worker) setJob(j *Job, sequence uint64, non *Nonce) {
 	w.lock.Unlock()
 	loggo.Debug("worker add done %v", sequence)
 }
+
+func (w *Worker) stop() {
+	w.cancel()
+	w.clearJob()
+}
+
+func (w *Worker) clearJob() {
+	w.lock.Lock()
+	w.wj = nil
+	w.lock.Unlock()
+	loggo.Debug("worker clear job")
+}
+
+// parseAffinity reads a cpu list like "0,2,4,6" or "0-3,8", empty means no pinning
+func parseAffinity(s string) ([]int, error) {
+	var cpus []int
+	for _, item := range splitList(s) {
+		lo, hi := item, item
+		if i := strings.Index(item, "-"); i > 0 {
+			lo, hi = item[:i], item[i+1:]
+		}
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, errors.New("bad cpu " + item)
+		}
+		last, err := strconv.Atoi(hi)
+		if err != nil || last < first {
+			return nil, errors.New("bad cpu range " + item)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
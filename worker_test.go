@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAffinity(t *testing.T) {
+	tests := []struct {
+		s    string
+		cpus []int
+		err  bool
+	}{
+		{s: ""},
+		{s: "3", cpus: []int{3}},
+		{s: "0,2,4,6", cpus: []int{0, 2, 4, 6}},
+		{s: "0-3", cpus: []int{0, 1, 2, 3}},
+		{s: " 1 , 4-5 ,", cpus: []int{1, 4, 5}},
+		{s: "2-2", cpus: []int{2}},
+		{s: "a", err: true},
+		{s: "-1", err: true},
+		{s: "3-1", err: true},
+		{s: "0-", err: true},
+		{s: "0,x-2", err: true},
+	}
+	for _, tt := range tests {
+		cpus, err := parseAffinity(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseAffinity(%q) = %v, want error", tt.s, cpus)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAffinity(%q) error %v", tt.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(cpus, tt.cpus) {
+			t.Errorf("parseAffinity(%q) = %v, want %v", tt.s, cpus, tt.cpus)
+		}
+	}
+}